@@ -0,0 +1,368 @@
+package certmin
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxIssuerDepth is the maximum number of issuers retrieved by following the
+// Issuing Certificate URLs if not set with WithMaxIssuerDepth.
+const DefaultMaxIssuerDepth = 10
+
+// maxResponseSize limits the size of the HTTP responses, LDAP messages and files
+// with certificates.
+const maxResponseSize = 1 << 20
+
+// ErrFileIssuerURLNotAllowed is returned for file:// Issuing Certificate URLs if
+// no issuer directory was set with WithFileIssuerURLs.
+var ErrFileIssuerURLNotAllowed = errors.New("file URL not allowed (no issuer directory)")
+
+// IssuerCache caches the certificates retrieved from Issuing Certificate URLs,
+// e.g. to share them between the locations of an application. It is safe for
+// concurrent use.
+type IssuerCache struct {
+	mutex sync.Mutex
+	certs map[string][]*x509.Certificate
+}
+
+// IssuerHop represents a request for the issuer of a certificate. Subject is the
+// subject of the certificate with the Issuing Certificate URL. Certs are the
+// certificates found at the URL and Cached is set if they were found in the
+// IssuerCache. ContentType is the media type of the HTTP response (empty for LDAP
+// and file URLs) and Err the error in case of failure.
+type IssuerHop struct {
+	Subject     string
+	URL         string
+	ContentType string
+	Certs       []*x509.Certificate
+	Cached      bool
+	Err         error
+}
+
+// NewIssuerCache creates an empty *IssuerCache.
+func NewIssuerCache() *IssuerCache {
+	return &IssuerCache{certs: make(map[string][]*x509.Certificate)}
+}
+
+// CompleteChain retrieves the issuers missing from a chain, e.g. the intermediates
+// a server did not send, from the Issuing Certificate URLs. The chain of the first
+// certificate is linked through the supplied certificates and followed like
+// RetrieveChainWithTrace from the last certificate found. The return values are a
+// []*x509.Certificate with the supplied certificates followed by the retrieved
+// ones, a []IssuerHop in the order of the requests and an error in case of failure.
+func (client *Client) CompleteChain(ctx context.Context,
+	certs []*x509.Certificate, options *RetrieveOptions) ([]*x509.Certificate, []IssuerHop, error) {
+	if len(certs) == 0 {
+		return nil, nil, errors.New("no certificates to complete")
+	}
+
+	last := certs[0]
+	linked := []*x509.Certificate{last}
+	for {
+		issuer := findIssuerIn(last, certs)
+		if issuer == nil || containsCert(linked, issuer) {
+			break
+		}
+		linked = append(linked, issuer)
+		last = issuer
+	}
+
+	completed := append([]*x509.Certificate{}, certs...)
+	if isSelfSigned(last) {
+		return completed, nil, nil
+	}
+	chain, hops, err := client.RetrieveChainWithTrace(ctx, last, options)
+	for _, cert := range chain[1:] {
+		if !containsCert(completed, cert) {
+			completed = append(completed, cert)
+		}
+	}
+	return completed, hops, err
+}
+
+// RetrieveChainWithTrace retrieves the chain for a certificate like
+// RetrieveChainFromIssuerURLs and also returns a trace of the requested URLs. The
+// chain is followed up to the maximum depth, without requesting an URL twice and
+// using the other certificates of a response (e.g. a PKCS7 bundle) before
+// requesting the next URL. Besides HTTP, the cACertificate and crossCertificatePair
+// attributes of ldap:// and ldaps:// URLs are searched with an anonymous bind (see
+// WithLDAPServer) and file:// URLs are read from a local mirror if allowed (see
+// WithFileIssuerURLs). The return values are a []*x509.Certificate (with the
+// first element being the supplied certificate), a []IssuerHop in the order of
+// the requests and an error in case of failure.
+func (client *Client) RetrieveChainWithTrace(ctx context.Context,
+	cert *x509.Certificate, options *RetrieveOptions) ([]*x509.Certificate, []IssuerHop, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+
+	httpClient := client.httpClientFor(options)
+	chain := []*x509.Certificate{cert}
+	var hops []IssuerHop
+	var candidates []*x509.Certificate
+	var lastErr error
+	visited := make(map[string]bool)
+	current := cert
+	for depth := 0; !isSelfSigned(current); depth++ {
+		issuer := findIssuerIn(current, candidates)
+		if issuer == nil && len(current.IssuingCertificateURL) == 0 {
+			break
+		}
+		if depth == client.maxIssuerDepth {
+			lastErr = fmt.Errorf("maximum depth of %d issuers reached", client.maxIssuerDepth)
+			break
+		}
+
+		for _, issuerURL := range current.IssuingCertificateURL {
+			if issuer != nil {
+				break
+			}
+			if visited[issuerURL] {
+				continue // loop
+			}
+			visited[issuerURL] = true
+
+			hop := client.fetchIssuer(ctx, httpClient, options, issuerURL)
+			hop.Subject = current.Subject.String()
+			hops = append(hops, hop)
+			if hop.Err != nil {
+				lastErr = hop.Err
+				continue
+			}
+			lastErr = nil
+			candidates = append(candidates, hop.Certs...)
+			issuer = findIssuerIn(current, hop.Certs)
+			if issuer == nil {
+				issuer = hop.Certs[0]
+			}
+		}
+
+		if issuer == nil || containsCert(chain, issuer) {
+			break
+		}
+		chain = append(chain, issuer)
+		current = issuer
+	}
+
+	return chain, hops, lastErr
+}
+
+// get returns the cached certificates of an URL
+func (cache *IssuerCache) get(url string) ([]*x509.Certificate, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	certs, ok := cache.certs[url]
+	return certs, ok
+}
+
+// put caches the certificates of an URL
+func (cache *IssuerCache) put(url string, certs []*x509.Certificate) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.certs[url] = certs
+}
+
+// fetchIssuer retrieves the certificates at an Issuing Certificate URL
+func (client *Client) fetchIssuer(
+	ctx context.Context, httpClient *http.Client, options *RetrieveOptions, rawURL string) IssuerHop {
+	hop := IssuerHop{URL: rawURL}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		hop.Err = err
+		return hop
+	}
+	key := client.issuerCacheKey(parsed, rawURL)
+	if certs, ok := client.issuerCache.get(key); ok {
+		hop.Certs = certs
+		hop.Cached = true
+		return hop
+	}
+
+	switch strings.ToLower(parsed.Scheme) {
+	case "ldap", "ldaps":
+		hop.Certs, hop.Err = client.fetchLDAPIssuer(ctx, rawURL, options)
+	case "file":
+		hop.Certs, hop.Err = readIssuerFile(parsed, client.fileIssuerDir)
+	default:
+		hop.Certs, hop.ContentType, hop.Err = fetchHTTPCerts(ctx, httpClient, rawURL)
+	}
+	if hop.Err == nil {
+		client.issuerCache.put(key, hop.Certs)
+	}
+	return hop
+}
+
+// issuerCacheKey returns the IssuerCache key of an Issuing Certificate URL. The
+// LDAP server of host-less LDAP URLs and the issuer directory of file URLs are
+// part of the key, as the certificates depend on them.
+func (client *Client) issuerCacheKey(parsed *url.URL, rawURL string) string {
+	switch strings.ToLower(parsed.Scheme) {
+	case "ldap", "ldaps":
+		if parsed.Host == "" {
+			return rawURL + "\n" + client.ldapServer
+		}
+	case "file":
+		return rawURL + "\n" + client.fileIssuerDir
+	}
+	return rawURL
+}
+
+// containsCert returns true if the certificate is part of certs
+func containsCert(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, candidate := range certs {
+		if bytes.Equal(candidate.Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeHTTPCerts decodes the certificates of a HTTP response with the decoder of
+// the content type (RFC 5280 4.2.2.1), falling back to DecodeCertBytes as servers
+// often send other types
+func decodeHTTPCerts(body []byte, contentType string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	var err error
+	switch contentType {
+	case "text/html":
+		return nil, errors.New("unexpected content type (" + contentType + ")")
+	case "application/pkix-cert":
+		certs, err = DecodeCertBytesPKCS1DER(body)
+	case "application/pkcs7-mime", "application/x-pkcs7-certificates":
+		certs, err = DecodeCertBytesPKCS7DER(body)
+	default:
+		err = errors.New("unknown content type")
+	}
+	if err != nil {
+		return DecodeCertBytes(body, "")
+	}
+	return certs, nil
+}
+
+// fetchHTTPCerts retrieves the certificates at a HTTP(S) URL, returning them with
+// the media type of the response
+func fetchHTTPCerts(
+	ctx context.Context, httpClient *http.Client, rawURL string) ([]*x509.Certificate, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK {
+		return nil, contentType, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, contentType, err
+	}
+	if len(body) > maxResponseSize {
+		return nil, contentType, fmt.Errorf("%s: response larger than %d bytes", rawURL, maxResponseSize)
+	}
+
+	certs, err := decodeHTTPCerts(body, contentType)
+	return certs, contentType, err
+}
+
+// findIssuerIn returns the certificate of certs that signed cert
+func findIssuerIn(cert *x509.Certificate, certs []*x509.Certificate) *x509.Certificate {
+	for _, candidate := range certs {
+		if bytes.Equal(candidate.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// isInDir returns true if the absolute path is located in the absolute dir
+func isInDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isSelfSigned returns true if the certificate signed itself
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// readIssuerFile reads the certificates of a file:// Issuing Certificate URL, e.g.
+// pointing to a local mirror. Only regular local files in dir (after resolving
+// symbolic links) are read, with file:// URLs refused with ErrFileIssuerURLNotAllowed
+// if dir is empty.
+func readIssuerFile(fileURL *url.URL, dir string) ([]*x509.Certificate, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("%w: %s", ErrFileIssuerURLNotAllowed, fileURL.String())
+	}
+	if fileURL.Host != "" && fileURL.Host != "localhost" {
+		return nil, errors.New("remote file URL not supported: " + fileURL.String())
+	}
+	path, err := resolveInDir(filepath.FromSlash(fileURL.Path), dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fileURL.String(), err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.New(path + ": not a regular file")
+	}
+	if info.Size() > maxResponseSize {
+		return nil, fmt.Errorf("%s: file larger than %d bytes", path, maxResponseSize)
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeHTTPCerts(body, "")
+}
+
+// resolveInDir returns the absolute path with the symbolic links resolved, or an
+// error if it is not located in dir. The path is checked before and after
+// resolving it, so no files outside of dir are accessed.
+func resolveInDir(path, dir string) (string, error) {
+	outside := errors.New("outside of the issuer directory")
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if !isInDir(absPath, absDir) {
+		return "", outside
+	}
+
+	realDir, err := filepath.EvalSymlinks(absDir)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return "", err
+	}
+	if !isInDir(realPath, realDir) {
+		return "", outside
+	}
+	return realPath, nil
+}
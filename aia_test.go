@@ -0,0 +1,231 @@
+package certmin
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nxadm/certmin/internal/testcert"
+	"github.com/stretchr/testify/assert"
+	"go.mozilla.org/pkcs7"
+)
+
+// testIssuerResponse is a response of the test Issuing Certificate URL server
+type testIssuerResponse struct {
+	contentType string
+	body        []byte
+}
+
+// startTestIssuerServer starts a HTTP server answering with the responses set in
+// the returned map, counting the requests per path. It returns the URL of the
+// server.
+func startTestIssuerServer(t *testing.T) (string, map[string]testIssuerResponse, map[string]int) {
+	responses := make(map[string]testIssuerResponse)
+	requests := make(map[string]int)
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests[req.URL.Path]++
+		response, ok := responses[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", response.contentType)
+		w.Write(response.body)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, responses, requests
+}
+
+func TestClient_CompleteChain(t *testing.T) {
+	url, responses, requests := startTestIssuerServer(t)
+	root, rootKey := testcert.Issued(t, "root", true, nil, nil)
+	inter, interKey := testcert.Issued(t, "inter", true, root, rootKey, url+"/root.crt")
+	leaf, _ := testcert.Issued(t, "leaf", true, inter, interKey, url+"/inter.crt")
+	responses["/inter.crt"] = testIssuerResponse{"application/pkix-cert", inter.Raw}
+	responses["/root.crt"] = testIssuerResponse{"application/pkix-cert", root.Raw}
+	other, _ := testcert.Issued(t, "other", true, nil, nil)
+
+	// Served without intermediate
+	completed, hops, err := NewClient().CompleteChain(context.Background(), []*x509.Certificate{leaf, other}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{leaf, other, inter, root}, completed)
+	assert.Equal(t, 2, len(hops))
+
+	// Served with intermediate: only the root is missing
+	completed, hops, err = NewClient().CompleteChain(context.Background(), []*x509.Certificate{leaf, inter}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{leaf, inter, root}, completed)
+	if assert.Equal(t, 1, len(hops)) {
+		assert.Equal(t, url+"/root.crt", hops[0].URL)
+	}
+
+	// Complete chain
+	completed, hops, err = NewClient().CompleteChain(context.Background(), []*x509.Certificate{leaf, inter, root}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{leaf, inter, root}, completed)
+	assert.Empty(t, hops)
+	assert.Equal(t, 1, requests["/inter.crt"])
+
+	_, _, err = NewClient().CompleteChain(context.Background(), nil, nil)
+	assert.Error(t, err)
+}
+
+func TestClient_RetrieveChainWithTrace(t *testing.T) {
+	url, responses, requests := startTestIssuerServer(t)
+	root, rootKey := testcert.Issued(t, "root", true, nil, nil)
+	inter, interKey := testcert.Issued(t, "inter", true, root, rootKey, url+"/root.p7c")
+	leaf, _ := testcert.Issued(t, "leaf", true, inter, interKey, url+"/missing.crt", url+"/inter.crt")
+	rootP7, err := pkcs7.DegenerateCertificate(root.Raw)
+	assert.NoError(t, err)
+	responses["/inter.crt"] = testIssuerResponse{"application/pkix-cert", inter.Raw}
+	responses["/root.p7c"] = testIssuerResponse{"application/pkcs7-mime", rootP7}
+
+	client := NewClient(WithTimeout(5 * time.Second))
+	chain, hops, err := client.RetrieveChainWithTrace(context.Background(), leaf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{leaf, inter, root}, chain)
+	if assert.Equal(t, 3, len(hops)) {
+		assert.Error(t, hops[0].Err) // 404
+		assert.Equal(t, url+"/inter.crt", hops[1].URL)
+		assert.Equal(t, "CN=leaf", hops[1].Subject)
+		assert.Equal(t, "application/pkix-cert", hops[1].ContentType)
+		assert.False(t, hops[1].Cached)
+		assert.Equal(t, "application/pkcs7-mime", hops[2].ContentType)
+	}
+
+	// Cached
+	chain, hops, err = client.RetrieveChainWithTrace(context.Background(), inter, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{inter, root}, chain)
+	if assert.Equal(t, 1, len(hops)) {
+		assert.True(t, hops[0].Cached)
+	}
+	assert.Equal(t, 1, requests["/root.p7c"])
+
+	// Maximum depth
+	client = NewClient(WithMaxIssuerDepth(1))
+	chain, _, err = client.RetrieveChainWithTrace(context.Background(), leaf, nil)
+	assert.Error(t, err)
+	assert.Equal(t, []*x509.Certificate{leaf, inter}, chain)
+
+	// Bundle with several certificates: the issuer of the next hop is not requested
+	bundle, err := pkcs7.DegenerateCertificate(append(append([]byte{}, root.Raw...), inter.Raw...))
+	assert.NoError(t, err)
+	responses["/bundle.p7c"] = testIssuerResponse{"application/pkcs7-mime", bundle}
+	leaf2, _ := testcert.Issued(t, "leaf2", true, inter, interKey, url+"/bundle.p7c")
+	chain, hops, err = NewClient().RetrieveChainWithTrace(context.Background(), leaf2, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{leaf2, inter, root}, chain)
+	assert.Equal(t, 1, len(hops))
+
+	// Loop: the retrieved certificate points back at the same URL
+	other, otherKey := testcert.Issued(t, "other", true, nil, nil)
+	loop, _ := testcert.Issued(t, "loop", true, other, otherKey, url+"/loop.crt")
+	responses["/loop.crt"] = testIssuerResponse{"application/pkix-cert", loop.Raw}
+	loop2, _ := testcert.Issued(t, "loop2", true, other, otherKey, url+"/loop.crt")
+	chain, hops, _ = NewClient().RetrieveChainWithTrace(context.Background(), loop2, nil)
+	assert.Equal(t, []*x509.Certificate{loop2, loop}, chain)
+	assert.Equal(t, 1, len(hops))
+
+	// Response too large and unexpected content type
+	responses["/large.crt"] = testIssuerResponse{"application/pkix-cert", make([]byte, maxResponseSize+1)}
+	responses["/page.html"] = testIssuerResponse{"text/html", []byte("<html></html>")}
+	for _, path := range []string{"/large.crt", "/page.html"} {
+		cert, _ := testcert.Issued(t, "cert", true, other, otherKey, url+path)
+		chain, _, err = NewClient().RetrieveChainWithTrace(context.Background(), cert, nil)
+		assert.Error(t, err)
+		assert.Equal(t, 1, len(chain))
+	}
+
+	// file:// URLs are only read from the issuer directory
+	dir, err := ioutil.TempDir("", "certmin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "inter.crt"), inter.Raw, 0600))
+	fileLeaf, _ := testcert.Issued(t, "leaf", true, inter, interKey,
+		"file://"+filepath.ToSlash(filepath.Join(dir, "inter.crt")))
+	chain, hops, err = NewClient().RetrieveChainWithTrace(context.Background(), fileLeaf, nil)
+	assert.Error(t, err)
+	assert.Equal(t, []*x509.Certificate{fileLeaf}, chain)
+	if assert.Equal(t, 1, len(hops)) {
+		assert.True(t, errors.Is(hops[0].Err, ErrFileIssuerURLNotAllowed))
+	}
+	assert.True(t, errors.Is(err, ErrFileIssuerURLNotAllowed))
+	chain, _, err = NewClient(WithFileIssuerURLs(dir)).RetrieveChainWithTrace(context.Background(), fileLeaf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{fileLeaf, inter, root}, chain)
+}
+
+func TestDecodeHTTPCerts(t *testing.T) {
+	cert, _ := testcert.Issued(t, "cert", true, nil, nil)
+	certs, err := decodeHTTPCerts(cert.Raw, "application/pkix-cert")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(certs))
+
+	// Wrong content type
+	certs, err = decodeHTTPCerts(cert.Raw, "application/octet-stream")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(certs))
+
+	_, err = decodeHTTPCerts([]byte("foo"), "application/pkix-cert")
+	assert.Error(t, err)
+	_, err = decodeHTTPCerts(cert.Raw, "text/html")
+	assert.Error(t, err)
+}
+
+func TestIsSelfSigned(t *testing.T) {
+	root, rootKey := testcert.Issued(t, "root", true, nil, nil)
+	cert, _ := testcert.Issued(t, "cert", true, root, rootKey)
+	assert.True(t, isSelfSigned(root))
+	assert.False(t, isSelfSigned(cert))
+}
+
+func TestReadIssuerFile(t *testing.T) {
+	path, err := filepath.Abs("t/ca.crt")
+	assert.NoError(t, err)
+	certs, err := readIssuerFile(&url.URL{Scheme: "file", Path: path}, "t")
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(certs)) {
+		assert.Equal(t, "Easy-RSA CA", certs[0].Subject.CommonName)
+	}
+
+	fileURL, err := url.Parse("file://localhost" + filepath.ToSlash(path))
+	assert.NoError(t, err)
+	_, err = readIssuerFile(fileURL, filepath.Dir(path))
+	assert.NoError(t, err)
+
+	// Refused without an issuer directory, before accessing the file
+	_, err = readIssuerFile(fileURL, "")
+	assert.True(t, errors.Is(err, ErrFileIssuerURLNotAllowed))
+	_, err = readIssuerFile(&url.URL{Scheme: "file", Path: filepath.Join(path, "missing.crt")}, "")
+	assert.True(t, errors.Is(err, ErrFileIssuerURLNotAllowed))
+	_, err = readIssuerFile(&url.URL{Scheme: "file", Host: "example.com", Path: path}, "t")
+	assert.Error(t, err)
+	_, err = readIssuerFile(&url.URL{Scheme: "file", Path: filepath.Dir(path)}, "t")
+	assert.Error(t, err)
+
+	// Outside of the issuer directory, also through a symbolic link
+	dir, err := ioutil.TempDir("", "certmin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_, err = readIssuerFile(&url.URL{Scheme: "file", Path: path}, dir)
+	assert.EqualError(t, err, "file://"+filepath.ToSlash(path)+": outside of the issuer directory")
+	_, err = readIssuerFile(&url.URL{Scheme: "file", Path: filepath.Join(dir, "..", "ca.crt")}, dir)
+	assert.Error(t, err)
+	if os.Symlink(path, filepath.Join(dir, "link.crt")) == nil {
+		_, err = readIssuerFile(&url.URL{Scheme: "file", Path: filepath.Join(dir, "link.crt")}, dir)
+		assert.Contains(t, err.Error(), "outside of the issuer directory")
+	}
+}
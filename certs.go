@@ -5,8 +5,11 @@ import (
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"io/ioutil"
@@ -24,6 +27,36 @@ type CertTree struct {
 	Intermediates, Roots []*x509.Certificate
 }
 
+// ClientCertificate combines certificates and their key (as returned by DecodeCertFile
+// and DecodeKeyFile) into a tls.Certificate for client authentication (see the
+// ClientCertificate field of RetrieveOptions). The certificate matching the key is
+// used as the leaf, with the others sent as its chain. The return values are a
+// *tls.Certificate and an error if no certificate matches the key.
+func ClientCertificate(certs []*x509.Certificate, key *pem.Block) (*tls.Certificate, error) {
+	var leaf *x509.Certificate
+	var chain [][]byte
+	for _, cert := range certs {
+		if leaf == nil && VerifyCertAndKey(cert, key) {
+			leaf = cert
+			continue
+		}
+		chain = append(chain, cert.Raw)
+	}
+	if leaf == nil {
+		return nil, errors.New("no certificate matches the key")
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	tlsCert, err := tls.X509KeyPair(certPEM, pem.EncodeToMemory(key))
+	if err != nil {
+		return nil, err
+	}
+	tlsCert.Certificate = append(tlsCert.Certificate, chain...)
+	tlsCert.Leaf = leaf
+
+	return &tlsCert, nil
+}
+
 // DecodeCertBytes reads a []byte with DER or PEM PKCS1, PKCS7 and PKCS12 encoded certificates,
 // and returns the contents as a []*x509.Certificate and an error if encountered. A password is
 // only needed for PKCS12.
@@ -372,6 +405,18 @@ func FindLeaf(certs []*x509.Certificate) (*x509.Certificate, error) {
 	}
 }
 
+// FingerprintSHA1 returns the SHA-1 fingerprint of a certificate as a []byte.
+func FingerprintSHA1(cert *x509.Certificate) []byte {
+	fingerprint := sha1.Sum(cert.Raw)
+	return fingerprint[:]
+}
+
+// FingerprintSHA256 returns the SHA-256 fingerprint of a certificate as a []byte.
+func FingerprintSHA256(cert *x509.Certificate) []byte {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return fingerprint[:]
+}
+
 // IsRootCA returns for a given *x509.Certificate true if
 // the CA is marked as IsCA and the Subject and the Issuer
 // are the same.
@@ -379,6 +424,14 @@ func IsRootCA(cert *x509.Certificate) bool {
 	return cert.IsCA && cert.Subject.String() == cert.Issuer.String()
 }
 
+// SPKIPinSHA256 returns the base64 encoded SHA-256 digest of the Subject Public Key
+// Info of a certificate, as used by HPKP, the Android network security config or
+// curl's --pinnedpubkey (prefixed with "sha256//").
+func SPKIPinSHA256(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
 // SortCerts sorts a []*x509.Certificate from leaf to root CA, or the other
 // way around if a the supplied boolean is set to true. Double elements are
 // removed.
@@ -449,6 +502,9 @@ func SortCertsAsChains(
 		skip[issuer] = true // we follow the issuers below
 		chain[subj] = []string{subj}
 		order = append(order, subj)
+		if issuer == subj { // self-signed, the chain is complete
+			continue
+		}
 		presentIssuer := issuer
 		for {
 			if _, ok := certByName[subj]; !ok {
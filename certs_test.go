@@ -2,6 +2,7 @@ package certmin
 
 import (
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"github.com/youmark/pkcs8"
 	"io/ioutil"
@@ -21,6 +22,25 @@ var (
 	testPassword = "1234"
 )
 
+func TestClientCertificate(t *testing.T) {
+	certs, err := DecodeCertFile("t/ca.crt", "")
+	assert.NoError(t, err)
+	leafs, err := DecodeCertFile("t/myserver.crt", "")
+	assert.NoError(t, err)
+	key, err := DecodeKeyFile("t/myserver.key", "")
+	assert.NoError(t, err)
+
+	tlsCert, err := ClientCertificate(append(certs, leafs...), key)
+	assert.NoError(t, err)
+	if assert.NotNil(t, tlsCert) {
+		assert.Equal(t, leafs[0], tlsCert.Leaf)
+		assert.Equal(t, [][]byte{leafs[0].Raw, certs[0].Raw}, tlsCert.Certificate)
+	}
+
+	_, err = ClientCertificate(certs, key)
+	assert.Error(t, err)
+}
+
 func TestDecodeCertBytes(t *testing.T) {
 	certBytes, err := ioutil.ReadFile("t/myserver.der")
 	assert.NoError(t, err)
@@ -266,6 +286,18 @@ func TestFindLeaf(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestFingerprintSHA1(t *testing.T) {
+	certs, err := DecodeCertFile("t/myserver.crt", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "6cbe7f7edeb9c8167c51a409786c5d4b837a2954", hex.EncodeToString(FingerprintSHA1(certs[0])))
+}
+
+func TestFingerprintSHA256(t *testing.T) {
+	certs, err := DecodeCertFile("t/myserver.crt", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "2c50423f4d624166b7561fe492c3cd28727449962763a1d375e1d14381e62060", hex.EncodeToString(FingerprintSHA256(certs[0])))
+}
+
 func TestIsRootCA(t *testing.T) {
 	certs, err := DecodeCertFile("t/myserver.crt", "")
 	assert.NoError(t, err)
@@ -276,6 +308,12 @@ func TestIsRootCA(t *testing.T) {
 	assert.True(t, IsRootCA(certs[0]))
 }
 
+func TestSPKIPinSHA256(t *testing.T) {
+	certs, err := DecodeCertFile("t/myserver.crt", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "Tq+2VNLpVpFvNoz658X3zNE94n6mh1/Rr0HIPyKV9cA=", SPKIPinSHA256(certs[0]))
+}
+
 func TestSortCerts(t *testing.T) {
 	certs, err := DecodeCertFile("t/chain-out-of-order.crt", "")
 	assert.NotNil(t, certs)
@@ -292,6 +330,11 @@ func TestSortCerts(t *testing.T) {
 		assert.Equal(t, 7, len(ordered))
 		assert.Contains(t, ordered[0].Subject.CommonName, "AAA Certificate Services")
 	}
+
+	// A self-signed certificate on its own
+	certs, err = DecodeCertFile("t/ca.crt", "")
+	assert.NoError(t, err)
+	assert.Equal(t, certs, SortCerts(certs, false))
 }
 
 func TestSortCertsAsChains(t *testing.T) {
@@ -312,6 +355,14 @@ func TestSortCertsAsChains(t *testing.T) {
 	assert.NotNil(t, certsByName)
 	assert.NotNil(t, order)
 	assert.Contains(t, chainAsCerts[ordered[0].Subject.String()][0].Subject.CommonName, "AAA Certificate Services")
+
+	// A self-signed certificate on its own is a complete chain
+	certs, err = DecodeCertFile("t/ca.crt", "")
+	assert.NoError(t, err)
+	chainAsCerts, _, order = SortCertsAsChains(certs, false)
+	if assert.Equal(t, 1, len(order)) {
+		assert.Equal(t, certs, chainAsCerts[order[0]])
+	}
 }
 
 func TestSplitCertsAsTree(t *testing.T) {
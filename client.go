@@ -0,0 +1,229 @@
+package certmin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client retrieves certificates and TLS details from remote hosts. It holds the
+// transport settings (dialer, HTTP client, trusted roots, retries and time-outs),
+// while the details of each connection are set in a *RetrieveOptions. The Timeout
+// field of RetrieveOptions is not used by a Client. Create it with NewClient. A
+// Client is safe for concurrent use.
+type Client struct {
+	dialContext      dialFunc
+	httpClient       *http.Client
+	rootCAs          *x509.CertPool
+	retries          int
+	backoff          time.Duration
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+	httpTimeout      time.Duration
+	maxIssuerDepth   int
+	issuerCache      *IssuerCache
+	ldapServer       string
+	fileIssuerDir    string
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// NewClient creates a *Client configured by the given options. Without options it
+// dials with a net.Dialer, verifies with the system roots, does not retry, has no
+// time-outs besides the deadline of the context and caches the certificates of
+// Issuing Certificate URLs for its own use.
+func NewClient(opts ...ClientOption) *Client {
+	client := &Client{
+		dialContext:    (&net.Dialer{}).DialContext,
+		maxIssuerDepth: DefaultMaxIssuerDepth,
+		issuerCache:    NewIssuerCache(),
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client
+}
+
+// WithDialContext sets the function used to open TCP connections, e.g. to inject
+// a test transport.
+func WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return func(client *Client) { client.dialContext = dial }
+}
+
+// WithDialTimeout sets the time-out for opening the connection, including the
+// negotiation with a proxy, with 0 disabling it.
+func WithDialTimeout(timeOut time.Duration) ClientOption {
+	return func(client *Client) { client.dialTimeout = timeOut }
+}
+
+// WithDialer sets the net.Dialer used to open TCP connections.
+func WithDialer(dialer *net.Dialer) ClientOption {
+	return func(client *Client) { client.dialContext = dialer.DialContext }
+}
+
+// WithFileIssuerURLs allows file:// Issuing Certificate URLs, e.g. pointing to a
+// local mirror, but only reads the files in dir and its subdirectories. Without
+// this option file:// URLs are refused.
+func WithFileIssuerURLs(dir string) ClientOption {
+	return func(client *Client) { client.fileIssuerDir = dir }
+}
+
+// WithHTTPClient sets the http.Client used to follow the Issuing Certificate URLs.
+// Its settings take precedence over the Proxy field of RetrieveOptions and the
+// HTTP time-out.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(client *Client) { client.httpClient = httpClient }
+}
+
+// WithHTTPTimeout sets the time-out of each HTTP or LDAP request, with 0 disabling
+// it.
+func WithHTTPTimeout(timeOut time.Duration) ClientOption {
+	return func(client *Client) { client.httpTimeout = timeOut }
+}
+
+// WithHandshakeTimeout sets the time-out for the StartTLS negotiation and the TLS
+// handshake, with 0 disabling it.
+func WithHandshakeTimeout(timeOut time.Duration) ClientOption {
+	return func(client *Client) { client.handshakeTimeout = timeOut }
+}
+
+// WithIssuerCache sets the cache of the certificates retrieved from Issuing
+// Certificate URLs, e.g. to share it between clients.
+func WithIssuerCache(cache *IssuerCache) ClientOption {
+	return func(client *Client) { client.issuerCache = cache }
+}
+
+// WithLDAPServer sets the server (host[:port]) queried for the ldap:/// Issuing
+// Certificate URLs without a host, like the ones published by Active Directory
+// Certificate Services (e.g. a domain controller).
+func WithLDAPServer(addr string) ClientOption {
+	return func(client *Client) { client.ldapServer = addr }
+}
+
+// WithMaxIssuerDepth sets the maximum number of issuers retrieved by following the
+// Issuing Certificate URLs.
+func WithMaxIssuerDepth(depth int) ClientOption {
+	return func(client *Client) { client.maxIssuerDepth = depth }
+}
+
+// WithRetries sets the number of times a failed connection is retried. The wait
+// before a retry starts at backoff and doubles with every attempt. Handshakes
+// rejected by the server are not retried.
+func WithRetries(retries int, backoff time.Duration) ClientOption {
+	return func(client *Client) {
+		client.retries = retries
+		client.backoff = backoff
+	}
+}
+
+// WithRootCAs sets the pool of trusted roots used to verify the certificates of
+// the server (default: the system roots).
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(client *Client) { client.rootCAs = pool }
+}
+
+// WithTimeout sets the dial, handshake and HTTP time-outs, with 0 disabling them.
+func WithTimeout(timeOut time.Duration) ClientOption {
+	return func(client *Client) {
+		client.dialTimeout = timeOut
+		client.handshakeTimeout = timeOut
+		client.httpTimeout = timeOut
+	}
+}
+
+// RetrieveCerts retrieves and verifies all the certificates offered by the remote
+// host like the RetrieveCerts function, with a context.Context to cancel the
+// retrieval.
+func (client *Client) RetrieveCerts(
+	ctx context.Context, addr string, options *RetrieveOptions) (*RetrievalResult, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+	return client.handshake(ctx, addr, options, nil)
+}
+
+// RetrieveChainFromIssuerURLs retrieves the chain for a certificate like the
+// RetrieveChainFromIssuerURLs function, using the Timeout and Proxy fields of a
+// *RetrieveOptions (nil for the defaults) for the HTTP connections and a
+// context.Context to cancel the retrieval.
+func (client *Client) RetrieveChainFromIssuerURLs(
+	ctx context.Context, cert *x509.Certificate, options *RetrieveOptions) ([]*x509.Certificate, error) {
+	chain, _, err := client.RetrieveChainWithTrace(ctx, cert, options)
+	return chain, err
+}
+
+// RetrieveHandshakeInfo retrieves the details of the TLS handshake with the remote
+// host like the RetrieveHandshakeInfo function, with a context.Context to cancel
+// the retrieval.
+func (client *Client) RetrieveHandshakeInfo(
+	ctx context.Context, addr string, options *RetrieveOptions) (*RetrievalResult, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+
+	sessionCache := tls.NewLRUClientSessionCache(1)
+	configure := func(config *tls.Config) { config.ClientSessionCache = sessionCache }
+	result, err := client.handshake(ctx, addr, options, configure)
+	if err != nil {
+		return nil, err
+	}
+
+	if !result.Handshake.DidResume {
+		if resumed, err := client.handshake(ctx, addr, options, configure); err == nil {
+			result.Handshake.DidResume = resumed.Handshake.DidResume
+		}
+	}
+
+	return result, nil
+}
+
+// clientForOptions returns the Client used by the functions of the package, with
+// the Timeout of options for every phase
+func clientForOptions(options *RetrieveOptions) *Client {
+	return NewClient(WithTimeout(options.Timeout))
+}
+
+// dial opens a connection to addr, through a proxy if needed, within the dial
+// time-out
+func (client *Client) dial(ctx context.Context, addr, proxyStr string) (net.Conn, error) {
+	if client.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.dialTimeout)
+		defer cancel()
+	}
+	return dialAddr(ctx, addr, proxyStr, client.dialContext)
+}
+
+// httpClientFor returns the http.Client used to download certificates and to
+// follow Issuing Certificate URLs
+func (client *Client) httpClientFor(options *RetrieveOptions) *http.Client {
+	if client.httpClient != nil {
+		return client.httpClient
+	}
+	return &http.Client{
+		Timeout: client.httpTimeout,
+		Transport: &http.Transport{
+			DialContext: client.dialContext,
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				return proxyForURL(options.Proxy, req.URL)
+			},
+		},
+	}
+}
+
+// wait sleeps before the given retry, returning false if the context is done
+func (client *Client) wait(ctx context.Context, retry int) bool {
+	timer := time.NewTimer(client.backoff << uint(retry-1))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,134 @@
+package certmin
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRoundTripper answers every HTTP request with the same body
+type testRoundTripper struct {
+	body     []byte
+	requests []string
+}
+
+func (rt *testRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests = append(rt.requests, req.URL.String())
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(rt.body)),
+		Request:    req,
+	}, nil
+}
+
+func TestNewClient(t *testing.T) {
+	client := NewClient()
+	assert.NotNil(t, client.dialContext)
+	assert.Equal(t, time.Duration(0), client.handshakeTimeout)
+
+	client = NewClient(WithTimeout(time.Second), WithHTTPTimeout(2*time.Second), WithRetries(3, time.Millisecond))
+	assert.Equal(t, time.Second, client.dialTimeout)
+	assert.Equal(t, time.Second, client.handshakeTimeout)
+	assert.Equal(t, 2*time.Second, client.httpTimeout)
+	assert.Equal(t, 3, client.retries)
+}
+
+func TestClient_RetrieveCerts(t *testing.T) {
+	cert := testSelfSignedCert(t)
+	addr := startTestServerWithConfig(t, nil, &tls.Config{Certificates: []tls.Certificate{cert}})
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	// Injected transport with retries
+	var dialed []string
+	dial := func(ctx context.Context, network, dialAddr string) (net.Conn, error) {
+		dialed = append(dialed, dialAddr)
+		if len(dialed) < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	client := NewClient(
+		WithDialContext(dial), WithRootCAs(pool), WithRetries(2, time.Millisecond), WithTimeout(5*time.Second))
+	result, err := client.RetrieveCerts(context.Background(), "myserver:443", &RetrieveOptions{Proxy: ProxyDirect})
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		assert.True(t, result.Verified()) // trusted through the root pool
+		assert.Equal(t, 1, len(result.PeerCertificates))
+	}
+	assert.Equal(t, []string{"myserver:443", "myserver:443", "myserver:443"}, dialed)
+
+	attempts := 0
+	refuse := func(ctx context.Context, network, dialAddr string) (net.Conn, error) {
+		attempts++
+		return nil, errors.New("connection refused")
+	}
+	client = NewClient(WithDialContext(refuse), WithRetries(1, time.Millisecond))
+	_, err = client.RetrieveCerts(context.Background(), "myserver:443", &RetrieveOptions{Proxy: ProxyDirect})
+	assert.Error(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// Cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewClient().RetrieveCerts(ctx, addr, &RetrieveOptions{Proxy: ProxyDirect})
+	assert.Equal(t, context.Canceled, err)
+
+	// Handshake time-out on a server that never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	start := time.Now()
+	client = NewClient(WithHandshakeTimeout(100 * time.Millisecond))
+	_, err = client.RetrieveCerts(context.Background(), listener.Addr().String(), &RetrieveOptions{Proxy: ProxyDirect})
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestClient_RetrieveChainFromIssuerURLs(t *testing.T) {
+	certs, err := DecodeCertFile("t/kuleuven-be.pem", "")
+	assert.NoError(t, err)
+	caBytes, err := ioutil.ReadFile("t/ca.crt")
+	assert.NoError(t, err)
+
+	transport := &testRoundTripper{body: caBytes}
+	client := NewClient(WithHTTPClient(&http.Client{Transport: transport}))
+	chain, err := client.RetrieveChainFromIssuerURLs(context.Background(), certs[0], nil)
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(chain)) {
+		assert.Equal(t, "Easy-RSA CA", chain[1].Subject.CommonName)
+	}
+	assert.Equal(t, certs[0].IssuingCertificateURL[:1], transport.requests)
+}
+
+func TestClient_RetrieveHandshakeInfo(t *testing.T) {
+	addr := startTestServerWithConfig(t, nil,
+		&tls.Config{Certificates: []tls.Certificate{testSelfSignedCert(t)}, MaxVersion: tls.VersionTLS12})
+	result, err := NewClient(WithTimeout(5*time.Second)).RetrieveHandshakeInfo(context.Background(), addr, nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		assert.Error(t, result.Warning()) // self-signed
+		assert.Equal(t, "TLS 1.2", result.Handshake.VersionName())
+		assert.True(t, result.Handshake.DidResume)
+	}
+}
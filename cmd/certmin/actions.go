@@ -1,168 +1,444 @@
 package main
 
 import (
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/fatih/color"
+	"io/ioutil"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/nxadm/certmin"
 )
 
 // actionFunc is a type for actions and their expected output as string and error.
+// A statusError is returned if a verification failed or a warning was given.
 type actionFunc func() (string, error)
 
-// skimCerts prints relevant information of local or remote certificates,
-// optionally including a remote chain.
-func skimCerts(locations []string, params Params) (string, error) {
-	var sb strings.Builder
-	w := tabwriter.NewWriter(&sb, 0, 0, 1, ' ', tabwriter.StripEscape)
+// report is the output of an action with its exit status
+type report struct {
+	strings.Builder
+	status int
+}
+
+// statusError is the exit status of an action that ran without errors but
+// with failed verifications or warnings, or of any outcome with --quiet. It is
+// not reported besides the exit status.
+type statusError int
+
+// Error returns the description of the exit status.
+func (err statusError) Error() string {
+	switch int(err) {
+	case exitFailed:
+		return "verification failed"
+	case exitWarning:
+		return "warnings were given"
+	default:
+		return "errors were reported"
+	}
+}
+
+// fail writes a failed verification message and sets the exit status.
+func (r *report) fail(msg string) {
+	r.WriteString(color.RedString(msg))
+	r.raise(exitFailed)
+}
+
+// raise sets the exit status if it's more severe than the current one:
+// errors over failed verifications over warnings.
+func (r *report) raise(status int) {
+	severity := map[int]int{exitOK: 0, exitWarning: 1, exitFailed: 2, exitError: 3}
+	if severity[status] > severity[r.status] {
+		r.status = status
+	}
+}
+
+// result returns the output and, if the exit status is not exitOK, a
+// statusError.
+func (r *report) result() (string, error) {
+	if r.status == exitOK {
+		return r.String(), nil
+	}
+	return r.String(), statusError(r.status)
+}
+
+// warn writes a warning and sets the exit status.
+func (r *report) warn(msg string) {
+	r.WriteString(color.YellowString(msg))
+	r.raise(exitWarning)
+}
 
+// warnExpiry warns for the certificates that expired or expire within the given
+// number of days.
+func (r *report) warnExpiry(certs []*x509.Certificate, days int) {
+	now := time.Now()
+	for _, cert := range certs {
+		switch {
+		case now.After(cert.NotAfter):
+			r.warn(fmt.Sprintf("WARNING: certificate %s expired on %s\n", cert.Subject.CommonName, cert.NotAfter))
+		case now.AddDate(0, 0, days).After(cert.NotAfter):
+			r.warn(fmt.Sprintf("WARNING: certificate %s expires within %d day(s), on %s\n",
+				cert.Subject.CommonName, days, cert.NotAfter))
+		}
+	}
+}
+
+// ctVerify verifies that local or remote certificates with embedded SCTs
+// are included in a Certificate Transparency log.
+func ctVerify(locations []string, params Params) (string, error) {
+	var sb report
+	keyBytes, err := ioutil.ReadFile(params.ctLogKey)
+	if err != nil {
+		return "", err
+	}
+	ctLog := urlClient(params).NewCTLog(params.ctLog, retrieveOptions(params))
+	ctLog.PublicKey, err = certmin.DecodeCTLogKey(keyBytes)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key of the log (%s)", err)
+	}
 	for _, input := range locations {
 		var certs []*x509.Certificate
-		colourKeeper := make(colourKeeper)
-
 		sb.WriteString("\nCertificate location " + input + ":\n\n")
-		certs, err := getCerts(input, &sb)
+		certs, err := getCerts(input, &sb, params)
 		if err != nil {
-			w.Flush()
 			return sb.String(), err
 		}
 
-		if params.leaf || params.follow { // We only want the leaf
-			leaf, err := certmin.FindLeaf(certs)
-			if err == nil {
-				certs = []*x509.Certificate{leaf}
-			} else {
-				certs = certmin.SortCerts(certs, false)
-				certs = []*x509.Certificate{certs[0]}
+		cert := certs[0]
+		issuer := findIssuer(cert, certs)
+		if issuer == nil {
+			chain, err := followIssuers(cert, &sb, &sb, params)
+			if err != nil {
+				return sb.String(), err
 			}
+			issuer = findIssuer(cert, chain)
+		}
+		if issuer == nil {
+			return sb.String(), errors.New("issuer of " + cert.Subject.CommonName + " not found")
 		}
 
-		if params.follow {
-			certs, err = certmin.RetrieveChainFromIssuerURLs(certs[0], timeOut)
-			if err != nil {
-				w.Flush()
-				return sb.String(), err
+		result, err := ctLog.VerifyInclusion(cert, issuer)
+		if err == nil {
+			sb.WriteString(fmt.Sprintf("Leaf hash:  %s\n", base64.StdEncoding.EncodeToString(result.LeafHash)))
+			sb.WriteString(fmt.Sprintf("Leaf index: %d\n", result.LeafIndex))
+			sb.WriteString(fmt.Sprintf("Tree size:  %d\n\n", result.STH.TreeSize))
+			msg := "certificate " + cert.Subject.CommonName + " is included in " + params.ctLog + "\n"
+			sb.WriteString(color.GreenString((msg)))
+		} else {
+			msg := "certificate " + cert.Subject.CommonName + " could not be verified in " + params.ctLog +
+				" (" + err.Error() + ")\n"
+			sb.fail(msg)
+		}
+		sb.WriteString("---\n")
+	}
+
+	return sb.result()
+}
+
+// scanTLS prints the protocol versions and cipher suites accepted by remote
+// locations.
+func scanTLS(locations []string, params Params) (string, error) {
+	var sb report
+	w := tabwriter.NewWriter(&sb, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	insecure := make(map[uint16]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.ID] = true
+	}
+
+	for _, input := range locations {
+		sb.WriteString("\nCertificate location " + input + ":\n\n")
+		loc, err := parseLocation(input, params)
+		if err != nil {
+			return sb.String(), err
+		}
+		if !loc.IsRemote() {
+			return sb.String(), errors.New(input + " is not a remote location")
+		}
+
+		options := retrieveOptions(params)
+		if options.StartTLS == "" {
+			options.StartTLS = loc.StartTLS
+		}
+		results, err := certmin.ScanTLS(loc.Addr(), options, params.workers)
+		if err != nil {
+			return sb.String(), err
+		}
+
+		for _, result := range results {
+			switch {
+			case !result.Accepted:
+				fmt.Fprintf(w, "%s:\tnot accepted\n", result.VersionName())
+			case result.Version < tls.VersionTLS12:
+				fmt.Fprintf(w, "%s:\t%s\n", result.VersionName(), color.RedString("accepted"))
+				sb.raise(exitWarning)
+			default:
+				fmt.Fprintf(w, "%s:\t%s\n", result.VersionName(), color.GreenString("accepted"))
+			}
+			for idx, suite := range result.CipherSuites {
+				name := tls.CipherSuiteName(suite)
+				if insecure[suite] {
+					name = color.RedString(name + " (insecure)")
+					sb.raise(exitWarning)
+				}
+				fmt.Fprintf(w, "\t%d. %s\n", idx+1, name)
 			}
 		}
+		fmt.Fprint(w, "---\n")
+		w.Flush()
+	}
+
+	return sb.result()
+}
 
-		if params.sort || params.rsort {
-			if params.once {
-				switch {
-				case params.sort:
+// skimCerts prints relevant information of local or remote certificates,
+// optionally including a remote chain.
+func skimCerts(locations []string, params Params) (string, error) {
+	var sb report
+	w := tabwriter.NewWriter(&sb, 0, 0, 1, ' ', tabwriter.StripEscape)
+
+	for _, input := range locations {
+		sb.WriteString("\nCertificate location " + input + ":\n\n")
+		groups, err := getCertGroups(input, &sb, params)
+		if err != nil {
+			w.Flush()
+			return sb.String(), err
+		}
+
+		for _, group := range groups {
+			certs := group.chain
+			colourKeeper := make(colourKeeper)
+			if len(group.sources) > 0 {
+				fmt.Fprintf(w, "%s:\t%s\n\t\n", group.label, strings.Join(group.sources, ", "))
+			}
+
+			if params.leaf || params.follow { // We only want the leaf
+				leaf, err := certmin.FindLeaf(certs)
+				if err == nil {
+					certs = []*x509.Certificate{leaf}
+				} else {
 					certs = certmin.SortCerts(certs, false)
-				case params.rsort:
-					certs = certmin.SortCerts(certs, true)
+					certs = []*x509.Certificate{certs[0]}
 				}
-			} else {
-				var chainAsCerts map[string][]*x509.Certificate
-				var order []string
-				switch {
-				case params.sort:
-					chainAsCerts, _, order = certmin.SortCertsAsChains(certs, false)
-				case params.rsort:
-					chainAsCerts, _, order = certmin.SortCertsAsChains(certs, true)
+			}
+
+			if params.follow {
+				certs, err = followIssuers(certs[0], w, &sb, params)
+				if err != nil {
+					w.Flush()
+					return sb.String(), err
 				}
+			}
 
-				var tmpCerts []*x509.Certificate
-				for _, subj := range order {
-					tmpCerts = append(tmpCerts, chainAsCerts[subj]...)
+			if params.sort || params.rsort {
+				if params.once {
+					switch {
+					case params.sort:
+						certs = certmin.SortCerts(certs, false)
+					case params.rsort:
+						certs = certmin.SortCerts(certs, true)
+					}
+				} else {
+					var chainAsCerts map[string][]*x509.Certificate
+					var order []string
+					switch {
+					case params.sort:
+						chainAsCerts, _, order = certmin.SortCertsAsChains(certs, false)
+					case params.rsort:
+						chainAsCerts, _, order = certmin.SortCertsAsChains(certs, true)
+					}
+
+					var tmpCerts []*x509.Certificate
+					for _, subj := range order {
+						tmpCerts = append(tmpCerts, chainAsCerts[subj]...)
+					}
+					certs = tmpCerts
 				}
-				certs = tmpCerts
 			}
-		}
 
-		for idx, cert := range certs {
-			printCert(cert, w, colourKeeper)
-			if idx < len(certs)-1 {
-				fmt.Fprintln(w, "\t")
+			for idx, cert := range certs {
+				printCert(cert, w, colourKeeper, params.digests)
+				if idx < len(certs)-1 {
+					fmt.Fprintln(w, "\t")
+				}
 			}
-		}
-		fmt.Fprint(w, "---\n")
+			w.Flush()
+			sb.warnExpiry(certs, params.expiryWarning)
+			fmt.Fprint(w, "---\n")
 
-		if params.keep {
-			output, err := writeCertFiles(certs, false)
-			if err != nil {
-				w.Flush()
-				return sb.String(), err
+			if params.keep {
+				output, err := writeCertFiles(certs, false)
+				if err != nil {
+					w.Flush()
+					return sb.String(), err
+				}
+				sb.WriteString("\n" + output)
 			}
-			sb.WriteString("\n" + output)
 		}
-
 	}
 
 	w.Flush()
-	return sb.String(), nil
+	return sb.result()
 }
 
-// verifyChain verifies that local or remote certificates match their chain,
-// supplied as local files, system-trust and/or remotely.
-func verifyChain(locations []string, params Params) (string, error) {
-	var sb strings.Builder
+// tlsInfo prints the details of the TLS handshake with remote locations,
+// followed by the certificates offered by the server.
+func tlsInfo(locations []string, params Params) (string, error) {
+	var sb report
+	w := tabwriter.NewWriter(&sb, 0, 0, 1, ' ', tabwriter.StripEscape)
+
 	for _, input := range locations {
-		var certs []*x509.Certificate
+		colourKeeper := make(colourKeeper)
 		sb.WriteString("\nCertificate location " + input + ":\n\n")
-		certs, err := getCerts(input, &sb)
+		loc, err := parseLocation(input, params)
 		if err != nil {
 			return sb.String(), err
 		}
-
-		cert := certs[0]
-		if params.follow {
-			certs, err = certmin.RetrieveChainFromIssuerURLs(cert, timeOut)
-			if err != nil {
-				return sb.String(), err
-			}
+		if !loc.IsRemote() {
+			return sb.String(), errors.New(input + " is not a remote location")
 		}
 
-		tree := certmin.SplitCertsAsTree(certs)
-		result, err := appendToCertTree(tree.Roots, params.roots)
+		options := retrieveOptions(params)
+		if options.StartTLS == "" {
+			options.StartTLS = loc.StartTLS
+		}
+		if options.StartTLS == "" {
+			options.ALPN = []string{"h2", "http/1.1"}
+		}
+		result, err := certmin.RetrieveHandshakeInfo(loc.Addr(), options)
 		if err != nil {
 			return sb.String(), err
 		}
-		tree.Roots = result
-		result, err = appendToCertTree(tree.Intermediates, params.inters)
+		if warn := result.Warning(); warn != nil {
+			sb.warn(warningMsg(warn) + "\n\n")
+		}
+		info := result.Handshake
+
+		printHandshakeInfo(info, w)
+		fmt.Fprintln(w, "\t")
+		for idx, cert := range info.PeerCertificates {
+			printCert(cert, w, colourKeeper, params.digests)
+			if idx < len(info.PeerCertificates)-1 {
+				fmt.Fprintln(w, "\t")
+			}
+		}
+		w.Flush()
+		sb.warnExpiry(info.PeerCertificates, params.expiryWarning)
+		fmt.Fprint(w, "---\n")
+		w.Flush()
+	}
+
+	return sb.result()
+}
+
+// verifyChain verifies that local or remote certificates match their chain,
+// supplied as local files, system-trust and/or remotely.
+func verifyChain(locations []string, params Params) (string, error) {
+	var sb report
+	for _, input := range locations {
+		sb.WriteString("\nCertificate location " + input + ":\n\n")
+		groups, err := getCertGroups(input, &sb, params)
 		if err != nil {
 			return sb.String(), err
 		}
-		tree.Intermediates = result
 
-		verified, _ := certmin.VerifyChain(tree)
-		if verified {
-			msg := "certificate " + cert.Subject.CommonName + " and its chain match\n"
-			sb.WriteString(color.GreenString((msg)))
-		} else {
-			msg := "certificate " + cert.Subject.CommonName + " and its chain do not match\n"
-			sb.WriteString(color.RedString((msg)))
-		}
-		sb.WriteString("---\n")
+		for _, group := range groups {
+			certs := group.chain
+			if len(group.sources) > 0 {
+				sb.WriteString(group.label + ": " + strings.Join(group.sources, ", ") + "\n")
+			}
 
-		if params.keep {
-			output, err := writeCertFiles(certs, false)
+			cert := certs[0]
+			if params.follow {
+				certs, err = followIssuers(cert, &sb, &sb, params)
+				if err != nil {
+					return sb.String(), err
+				}
+			}
+
+			verified, err := verifyCertChain(certs, nil, params)
 			if err != nil {
 				return sb.String(), err
 			}
-			sb.WriteString("\n" + output)
+			switch {
+			case verified:
+				msg := "certificate " + cert.Subject.CommonName + " and its chain match\n"
+				sb.WriteString(color.GreenString((msg)))
+			case params.follow || params.noComplete:
+				msg := "certificate " + cert.Subject.CommonName + " and its chain do not match\n"
+				sb.fail(msg)
+			default:
+				certs, err = verifyCompletedChain(certs, &sb, params)
+				if err != nil {
+					return sb.String(), err
+				}
+			}
+			sb.warnExpiry(certs, params.expiryWarning)
+			sb.WriteString("---\n")
+
+			if params.keep {
+				output, err := writeCertFiles(certs, false)
+				if err != nil {
+					return sb.String(), err
+				}
+				sb.WriteString("\n" + output)
+			}
 		}
+	}
 
+	return sb.result()
+}
+
+// verifyCompletedChain reports a chain that does not match as served and verifies
+// it again after retrieving the missing issuers from the Issuing Certificate URLs.
+// It returns the completed chain if it matches and the served chain otherwise.
+func verifyCompletedChain(
+	certs []*x509.Certificate, sb *report, params Params) ([]*x509.Certificate, error) {
+	cert := certs[0]
+	completed, err := completeChain(certs, sb, params)
+	fetched := completed[len(certs):]
+	if len(fetched) == 0 {
+		if err != nil {
+			sb.warn("WARNING: chain not completed (" + fileIssuersHint(err) + ")\n")
+		}
+		msg := "certificate " + cert.Subject.CommonName + " and its chain do not match\n"
+		sb.fail(msg)
+		return certs, nil
 	}
 
-	return sb.String(), nil
+	msg := "certificate " + cert.Subject.CommonName + " and its chain do not match as served\n"
+	sb.WriteString(color.RedString((msg)))
+	verified, err := verifyCertChain(certs, fetched, params)
+	if err != nil {
+		return certs, err
+	}
+	if !verified {
+		msg = fmt.Sprintf("certificate %s and its chain do not match either after retrieving %d missing "+
+			"certificate(s) from the Issuer Certificate URLs\n", cert.Subject.CommonName, len(fetched))
+		sb.fail(msg)
+		return certs, nil
+	}
+	msg = fmt.Sprintf("certificate %s and its chain match after retrieving %d missing certificate(s) "+
+		"from the Issuer Certificate URLs: the served chain is incomplete\n", cert.Subject.CommonName, len(fetched))
+	sb.warn(msg)
+	return completed, nil
 }
 
 // verifyKey verifies a local or remote certificate and a key match
 func verifyKey(keyFile string, locations []string, params Params) (string, error) {
-	var sb strings.Builder
-	key, err := certmin.DecodeKeyFile(keyFile, "")
+	var sb report
+	key, err := decodeKey(keyFile, "")
 	if err != nil {
-		passwordBytes, err := promptForKeyPassword()
+		password, err := keyPassword(params)
 		if err != nil {
 			return "", err
 		}
 
-		key, err = certmin.DecodeKeyFile(keyFile, string(passwordBytes))
+		key, err = decodeKey(keyFile, password)
 		if err != nil {
 			return "", err
 		}
@@ -171,7 +447,7 @@ func verifyKey(keyFile string, locations []string, params Params) (string, error
 	for _, input := range locations {
 		var certs []*x509.Certificate
 		sb.WriteString("\nCertificate location " + input + ":\n\n")
-		certs, err := getCerts(input, &sb)
+		certs, err := getCerts(input, &sb, params)
 		if err != nil {
 			return sb.String(), err
 		}
@@ -183,7 +459,7 @@ func verifyKey(keyFile string, locations []string, params Params) (string, error
 			sb.WriteString(color.GreenString((msg)))
 		} else {
 			msg := "certificate " + cert.Subject.CommonName + " and its key do not match\n"
-			sb.WriteString(color.RedString((msg)))
+			sb.fail(msg)
 		}
 		sb.WriteString("---\n")
 
@@ -197,5 +473,5 @@ func verifyKey(keyFile string, locations []string, params Params) (string, error
 
 	}
 
-	return sb.String(), nil
+	return sb.result()
 }
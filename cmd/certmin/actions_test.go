@@ -1,22 +1,125 @@
 package main
 
 import (
-	"github.com/fatih/color"
-	"github.com/stretchr/testify/assert"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/fatih/color"
+	"github.com/nxadm/certmin/internal/testcert"
+	"github.com/stretchr/testify/assert"
 )
 
+func TestReport_Result(t *testing.T) {
+	var sb report
+	output, err := sb.result()
+	assert.Empty(t, output)
+	assert.Nil(t, err)
+
+	sb.warn("warning\n")
+	_, err = sb.result()
+	assert.Equal(t, statusError(exitWarning), err)
+	sb.fail("failed\n")
+	sb.warn("warning\n")
+	output, err = sb.result()
+	assert.Contains(t, output, "failed")
+	assert.Equal(t, statusError(exitFailed), err)
+	sb.raise(exitError)
+	sb.raise(exitWarning)
+	_, err = sb.result()
+	assert.Equal(t, statusError(exitError), err)
+	assert.NotEmpty(t, err.Error())
+}
+
+func TestCtVerify(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	var params Params
+	params.ctLog = server.URL
+	params.ctLogKey = "t/ct-log.pub"
+	output, err := ctVerify([]string{"t/cert-and-chain.crt"}, params)
+	assert.Contains(t, output, "could not be verified")
+	assert.Equal(t, statusError(exitFailed), err)
+
+	params.ctLogKey = "t/myserver.crt"
+	_, err = ctVerify([]string{"t/cert-and-chain.crt"}, params)
+	assert.NotNil(t, err)
+	params.ctLogKey = "t/ct-log.pub"
+
+	_, err = ctVerify([]string{"t/myserver.crt"}, params)
+	assert.NotNil(t, err)
+}
+
+func TestScanTLS(t *testing.T) {
+	color.NoColor = true
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	var params Params
+	output, err := scanTLS([]string{server.Listener.Addr().String()}, params)
+	assert.Regexp(t, "TLS 1.1:\\s+not accepted", output)
+	assert.Regexp(t, "TLS 1.2:\\s+accepted\\s+1. TLS_", output)
+	assert.Regexp(t, "TLS 1.3:\\s+not accepted", output)
+	assert.Nil(t, err)
+
+	_, err = scanTLS([]string{"t/myserver.crt"}, params)
+	assert.NotNil(t, err)
+}
+
 func TestSkimCerts(t *testing.T) {
 	color.NoColor = true
 	var params Params
 	output, err := skimCerts([]string{"t/myserver.crt"}, params)
 	assert.Regexp(t, "Subject:\\s+CN=myserver", output)
-	assert.Nil(t, err)
+	assert.Contains(t, output, "WARNING: certificate myserver expired on")
+	assert.Equal(t, statusError(exitWarning), err)
 
 	_, err = skimCerts([]string{"main.go"}, params)
 	assert.NotNil(t, err)
 
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	params.allVariants = true
+	output, err = skimCerts([]string{server.Listener.Addr().String(), "t/myserver.crt"}, params)
+	assert.Regexp(t, "Handshakes:\\s+default, TLS 1.2, RSA", output)
+	assert.Regexp(t, "Subject:\\s+O=Acme Co", output)
+	assert.Regexp(t, "Subject:\\s+CN=myserver", output)
+	assert.Equal(t, statusError(exitWarning), err) // expired
+	params.allVariants = false
+
+	params.allIPs = true
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	output, err = skimCerts([]string{"localhost:" + port}, params)
+	assert.Regexp(t, "Addresses:\\s+127.0.0.1", output)
+	assert.Regexp(t, "Subject:\\s+O=Acme Co", output)
+	assert.Equal(t, statusError(exitWarning), err) // unknown authority
+	params.allIPs = false
+
+	// Expiring within the given number of days
+	dir, err := ioutil.TempDir("", "certmin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cert, _ := testcert.Issued(t, "expiring", false, nil, nil) // valid for an hour
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "expiring.crt"), cert.Raw, 0600))
+	output, err = skimCerts([]string{filepath.Join(dir, "expiring.crt")}, params)
+	assert.NotContains(t, output, "WARNING")
+	assert.Nil(t, err)
+	params.expiryWarning = 1
+	output, err = skimCerts([]string{filepath.Join(dir, "expiring.crt")}, params)
+	assert.Contains(t, output, "WARNING: certificate expiring expires within 1 day(s), on")
+	assert.Equal(t, statusError(exitWarning), err)
+	params.expiryWarning = 0
+
 	if os.Getenv("AUTHOR_TESTING") != "" {
 		output, err = skimCerts([]string{"https://github.com"}, params)
 		assert.Regexp(t, "Subject:\\s+CN=github.com", output)
@@ -33,6 +136,22 @@ func TestSkimCerts(t *testing.T) {
 	color.NoColor = false
 }
 
+func TestTlsInfo(t *testing.T) {
+	color.NoColor = true
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	var params Params
+	output, err := tlsInfo([]string{server.Listener.Addr().String()}, params)
+	assert.Regexp(t, "Protocol version:\\s+TLS 1.3", output)
+	assert.Regexp(t, "ALPN protocol:\\s+http/1.1", output)
+	assert.Regexp(t, "Subject:\\s+O=Acme Co", output)
+	assert.Equal(t, statusError(exitWarning), err) // unknown authority
+
+	_, err = tlsInfo([]string{"t/myserver.crt"}, params)
+	assert.NotNil(t, err)
+}
+
 func TestVerifyChain(t *testing.T) {
 	var params Params
 	params.roots = []string{"t/cert-and-chain.crt"}
@@ -43,7 +162,7 @@ func TestVerifyChain(t *testing.T) {
 	params.roots = []string{"t/myserver.crt"}
 	output, err = verifyChain([]string{"t/cert-and-chain.crt"}, params)
 	assert.Contains(t, output, "its chain do not match")
-	assert.Nil(t, err)
+	assert.Equal(t, statusError(exitFailed), err)
 
 	if os.Getenv("AUTHOR_TESTING") != "" {
 		// System's keystore
@@ -55,10 +174,70 @@ func TestVerifyChain(t *testing.T) {
 		params.roots = []string{"t/cert-and-chain.crt"}
 		output, err = verifyChain([]string{"github.com"}, params)
 		assert.Contains(t, output, "its chain do not match")
-		assert.Nil(t, err)
+		assert.Equal(t, statusError(exitFailed), err)
 	}
 }
 
+func TestVerifyCompletedChain(t *testing.T) {
+	color.NoColor = true
+	dir, err := ioutil.TempDir("", "certmin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	root, rootKey := testcert.Issued(t, "root", true, nil, nil)
+	inter, interKey := testcert.Issued(t, "inter", true, root, rootKey)
+	leaf, _ := testcert.Issued(t, "leaf", false, inter, interKey, "file://"+filepath.ToSlash(filepath.Join(dir, "inter.crt")))
+
+	// Served without the intermediate
+	served := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})...)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "served.crt"), served, 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "inter.crt"), inter.Raw, 0600))
+
+	// file:// Issuer URLs are refused without a mirror directory
+	params := Params{verbose: true}
+	output, err := verifyChain([]string{filepath.Join(dir, "served.crt")}, params)
+	assert.Equal(t, statusError(exitFailed), err)
+	assert.Contains(t, output, "not allowed")
+	assert.Contains(t, output, "use --file-issuers=dir")
+
+	// Following them is a warning instead of an error
+	params.follow = true
+	output, err = verifyChain([]string{filepath.Join(dir, "served.crt")}, params)
+	assert.Equal(t, statusError(exitFailed), err) // chain does not match
+	assert.Contains(t, output, "WARNING: file URL not allowed")
+	assert.Contains(t, output, "certificate leaf and its chain do not match\n")
+	params.follow = false
+
+	params.fileIssuers = dir
+	output, err = verifyChain([]string{filepath.Join(dir, "served.crt")}, params)
+	assert.Equal(t, statusError(exitWarning), err) // incomplete chain
+	assert.Contains(t, output, "certificate leaf and its chain do not match as served")
+	assert.Contains(t, output, "certificate leaf and its chain match after retrieving 1 missing certificate(s)")
+	assert.Contains(t, output, "inter.crt\n  1 certificate(s)")
+
+	params.noComplete = true
+	output, err = verifyChain([]string{filepath.Join(dir, "served.crt")}, params)
+	assert.Equal(t, statusError(exitFailed), err)
+	assert.Contains(t, output, "certificate leaf and its chain do not match\n")
+
+	// With the root as file
+	other, _ := testcert.Issued(t, "other", true, nil, nil)
+	for name, cert := range map[string]*x509.Certificate{"leaf.crt": leaf, "root.crt": root, "other.crt": other} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), cert.Raw, 0600))
+	}
+	params = Params{roots: []string{filepath.Join(dir, "root.crt")}, fileIssuers: dir}
+	output, err = verifyChain([]string{filepath.Join(dir, "leaf.crt")}, params)
+	assert.Equal(t, statusError(exitWarning), err)
+	assert.Contains(t, output, "certificate leaf and its chain match after retrieving 1 missing certificate(s)")
+
+	// The completed chain does not lead to the given root
+	params.roots = []string{filepath.Join(dir, "other.crt")}
+	output, err = verifyChain([]string{filepath.Join(dir, "leaf.crt")}, params)
+	assert.Equal(t, statusError(exitFailed), err)
+	assert.Contains(t, output, "do not match either after retrieving 1 missing certificate(s)")
+}
+
 func TestVerifyKey(t *testing.T) {
 	var params Params
 	params.roots = []string{"t/cert-and-chain.crt"}
@@ -68,11 +247,33 @@ func TestVerifyKey(t *testing.T) {
 
 	output, err = verifyKey("t/myserver.key", []string{"t/myserver-fromca2.crt"}, params)
 	assert.Contains(t, output, "do not match")
+	assert.Equal(t, statusError(exitFailed), err)
+
+	// Encrypted key with the password from a file
+	file, err := ioutil.TempFile("", "certmin")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString("1234\n")
+	file.Close()
+	params.passwordFile = file.Name()
+	output, err = verifyKey("t/myserver_enc.key", []string{"t/myserver.crt"}, params)
+	assert.Contains(t, output, "its key match")
+	assert.Nil(t, err)
+	params.passwordFile = ""
+
+	// Key and certificate piped together
+	keyBytes, err := ioutil.ReadFile("t/myserver.key")
+	assert.NoError(t, err)
+	certBytes, err := ioutil.ReadFile("t/myserver.crt")
+	assert.NoError(t, err)
+	setStdin(t, append(keyBytes, certBytes...))
+	output, err = verifyKey("-", []string{"-"}, params)
+	assert.Contains(t, output, "its key match")
 	assert.Nil(t, err)
 
 	if os.Getenv("AUTHOR_TESTING") != "" {
 		output, err = verifyKey("t/myserver.key", []string{"google.com"}, params)
 		assert.Contains(t, output, "do not match")
-		assert.Nil(t, err)
+		assert.Equal(t, statusError(exitFailed), err)
 	}
 }
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
+	"github.com/nxadm/certmin"
 	flag "github.com/spf13/pflag"
 )
 
@@ -14,53 +18,166 @@ const usage = `certmin, ` + version + `. A minimalist certificate utility.
 See ` + website + ` for more information.
 
 Usage:
-  certmin skim cert-location1 [cert-location2...] 
-    [--leaf|--follow] [--no-roots]
-    [--sort|--rsort] [--once] [--keep] [--no-colour]
+  certmin skim cert-location1 [cert-location2...]
+    [--leaf|--follow [--verbose]] [--no-roots]
+    [--sort|--rsort] [--once] [--keep] [--no-colour] [--quiet] [--download]
+    [--digest=sha1,sha256,spki|none] [--all-variants|--all-ips]
+    [--expiry-warning=days] [password options] [remote options]
   certmin verify-chain cert-location [cert-location2...]
     [--root=ca-file1 --root=ca-file2...]
     [--inter=inter-file1 --inter=inter-file2...]
-    [--leaf|--follow] [--no-roots]
-    [--sort|--rsort] [--keep] [--no-colour]
+    [--leaf|--follow] [--no-complete] [--verbose] [--no-roots]
+    [--sort|--rsort] [--keep] [--no-colour] [--quiet] [--all-ips] [--download]
+    [--expiry-warning=days] [password options] [remote options]
   certmin verify-key key-file cert-location1 [cert-location2...]
-    [--keep] [--no-colour]
+    [--keep] [--no-colour] [--quiet] [--download] [password options]
+    [remote options]
+  certmin ct-verify cert-location1 [cert-location2...] --log=log-url
+    --log-key=key-file [--no-colour] [--quiet] [--download] [remote options]
+  certmin tls-info remote-location1 [remote-location2...]
+    [--digest=sha1,sha256,spki|none] [--expiry-warning=days] [--no-colour]
+    [--quiet] [remote options]
+  certmin scan-tls remote-location1 [remote-location2...]
+    [--workers=number] [--no-colour] [--quiet] [remote options]
   certmin [-h]
   certmin [-v]
 
 Certificate locations can be local files or remote addresses. Remote locations
-can be a hostname with optionally a port attached by ":" (defaults to port
-443) or an URL (scheme://hostname for known schemes like https, ldaps, smtps,
-etc. or scheme://hostname:port for non-standard ports). When verifying a
-chain, the OS trust store will be used if no roots certificates are given as
-files or remotely requested. 
+can be a hostname or IP address with optionally a port attached by ":"
+(defaults to port 443, IPv6 addresses with a port between brackets like
+[2001:db8::1]:8443) or an URL (scheme://hostname for known schemes like https,
+ldaps, smtps, etc. or scheme://hostname:port for non-standard ports). The smtp,
+submission, imap, pop3, ftp, postgres, mysql, ldap, xmpp and xmpp-server schemes
+upgrade the connection to TLS with the protocol's own negotiation. No SNI is
+sent for IP addresses. HTTP(S) URLs prefixed with "get+" (or all of them with
+--download), like get+https://pki.example.com/ca.crt, are certificate files
+(PEM, DER or PKCS7) to download instead. A location (or the key file of
+verify-key) of "-" is read from stdin, once, so a key and its certificate can
+be piped together. When verifying a chain, the OS trust store will be used if
+no roots certificates are given as files or remotely requested.
 
 Actions:
   skim         | sc : skim certificates (including bundles).
-  verify-chain | vc : match certificates again its chain(s).
+  verify-chain | vc : match certificates again its chain(s). If a chain does
+                      not match as served, its missing issuers are retrieved
+                      from the Issuer Certificate URIs (as intermediates) and
+                      the chain is matched again.
   verify-key   | vk : match keys against certificate(s).
+  ct-verify    | ct : verify the inclusion of certificate(s) with embedded
+                      SCTs in a Certificate Transparency log.
+  tls-info     | ti : show the details of the TLS handshake (protocol
+                      version, cipher suite, key exchange group, ALPN,
+                      session resumption, OCSP stapling and client
+                      certificate request) and the offered certificates.
+  scan-tls     | st : list the accepted protocol versions and cipher suites
+                      in the server's order of preference.
 
 Global options (optional):
   --leaf      | -l  : show only the local or remote leaf, not the chain.
   --no-roots  | -n  : don't retrieve root certificates.
   --follow    | -f  : follow Issuer Certificate URIs to retrieve chain.
+  --no-complete     : don't retrieve the missing issuers of a chain that does
+                      not match as served.
+  --verbose         : show the requested Issuer Certificate URIs, their
+                      content type and the certificates found when following
+                      or completing a chain.
   --root      | -r  : root certificate file(s).
   --inter     | -i  : intermediate certificate file(s).
+  --log             : URL of a Certificate Transparency log (RFC 6962).
+  --log-key         : public key file of the log (PEM, DER or base64 encoded
+                      DER as in the log lists) to verify its signed tree
+                      head and to select its SCTs.
   --sort      | -s  : sort the certificates and chains from leaf to root.
   --rsort     | -z  : sort the certificates and chains from root to leaf.
+  --digest    | -d  : digests to show when skimming: sha1 and/or sha256
+                      certificate fingerprints, spki for the SHA-256 pin
+                      of the public key or none (default: sha256).
   --once      | -o  : if within a location several certificates share an
                       intermediate/root, don't show certificates more than
                       once to visually complete the chain. If "rsort" not
                       given it enables "sort".
   --keep      | -k  : write the requested certificates and chains to files
                       as PKCS1 PEM files (converting if necessary).
+  --all-variants    : show every distinct certificate chain offered by a
+                      remote location to clients with different cipher
+                      suites, curves, ALPN protocols and with or without SNI
+                      (e.g. both an ECDSA and a RSA certificate).
+  --all-ips         : retrieve the certificates from every IP address (A and
+                      AAAA records) of a remote location with the same SNI
+                      and report the addresses serving different chains.
+  --download        : download the http:// and https:// locations as certificate
+                      files instead of connecting to the server.
+  --expiry-warning  : warn for the certificates that expire within the given
+                      number of days, with 0 only warning for the expired
+                      ones (default: 30).
   --no-colour | -c  : don't colourise the output.
+  --quiet     | -q  : don't show the output, only set the exit status.
+  --workers         : maximum number of concurrent handshakes when scanning
+                      (default: 4).
   --help      | -h  : this help message.
   --version   | -v  : version message.
+
+Password options (optional, the password is prompted for if not given):
+  --password-env    : environment variable with the password of encrypted
+                      keys and PKCS12 files.
+  --password-file   : file with the password on its first line.
+  --password-fd     : file descriptor to read the password from, e.g. 3
+                      with 3<<<"$PASSWORD".
+  --key-password    : password of encrypted keys only, as pass:password
+                      (visible to other users), env:VAR, file:path or fd:N.
+  --cert-password   : password of PKCS12 certificate files only (also the
+                      client certificate), as for --key-password.
+
+Remote options (optional):
+  --starttls        : upgrade the connection with STARTTLS using the given
+                      protocol: smtp, imap, pop3, ftp, postgres, mysql,
+                      ldap, xmpp or xmpp-server
+                      (default: derived from the URL scheme).
+  --sni             : send the given name as SNI and verify the certificate
+                      for it (default: the hostname of the location).
+  --no-sni          : don't send SNI.
+  --connect         : connect to the given ip[:port] address instead of
+                      the location (like curl's --resolve).
+  --proxy           : connect through a HTTP CONNECT (http://host:port) or
+                      SOCKS5 (socks5://host:port) proxy, with optionally
+                      user:password@ before the host, or "direct" to ignore
+                      the proxy environment variables (default: from
+                      HTTPS_PROXY, ALL_PROXY and NO_PROXY). Also used to
+                      follow the Issuer Certificate URLs.
+  --client-cert     : client certificate file (with its chain) sent when the
+                      server requests client authentication. PKCS12 files
+                      can include the key.
+  --client-key      : key file of the client certificate.
+  --ldap-server     : LDAP server (host[:port]) queried when following
+                      ldap:/// Issuer Certificate URLs without a host, like
+                      the ones of Active Directory Certificate Services.
+  --file-issuers    : directory of a local mirror from which file:// Issuer
+                      Certificate URLs are read (default: these URLs are
+                      refused).
+  --timeout         : time-out of each phase of a connection (connecting,
+                      handshake and HTTP requests), e.g. 10s. 0 disables it
+                      (default: 5s).
+
+Exit status:
+  0: success.
+  1: error (e.g. a location that can not be read or reached).
+  2: failed verification (e.g. a certificate that does not match its chain,
+     its key or a Certificate Transparency log).
+  3: warnings, but no failed verifications (e.g. a certificate that does not
+     match the hostname or expires soon, an incomplete chain or insecure
+     protocol versions and cipher suites).
 `
 
 type Params struct {
-	help, progVersion, leaf, follow, noRoots, sort, rsort, once, keep bool
-	roots, inters                                                     []string
+	help, progVersion, quiet, verbose, leaf, follow, noComplete, download, noRoots, sort, rsort, once, keep, noSNI, allVariants, allIPs bool
+	roots, inters, digests                                                                                                              []string
+	ctLog, ctLogKey, starttls, sni, connect, proxy, clientCertFile, clientKeyFile, ldapServer, fileIssuers                              string
+	workers, expiryWarning                                                                                                              int
+	timeout                                                                                                                             time.Duration
+	clientCert                                                                                                                          *tls.Certificate
+
+	// Password sources
+	passwordEnv, passwordFile, passwordFd, keyPassword, certPassword string
 }
 
 // getAction returns an action function, a msg for early exit and an error.
@@ -79,12 +196,38 @@ func getAction() (actionFunc, string, error) {
 	inters := flags.StringSliceP("inter", "i", []string{}, "")
 	leaf := flags.BoolP("leaf", "l", false, "")
 	follow := flags.BoolP("follow", "f", false, "")
+	verbose := flags.Bool("verbose", false, "")
+	quiet := flags.BoolP("quiet", "q", false, "")
+	noComplete := flags.Bool("no-complete", false, "")
+	download := flags.Bool("download", false, "")
 	noRoots := flags.BoolP("no-roots", "n", false, "")
 	sort := flags.BoolP("sort", "s", false, "")
 	rsort := flags.BoolP("rsort", "z", false, "")
 	once := flags.BoolP("once", "o", false, "")
 	keep := flags.BoolP("keep", "k", false, "")
 	noColour := flags.BoolP("no-colour", "c", false, "")
+	ctLog := flags.String("log", "", "")
+	ctLogKey := flags.String("log-key", "", "")
+	digests := flags.StringSliceP("digest", "d", []string{"sha256"}, "")
+	starttls := flags.String("starttls", "", "")
+	sni := flags.String("sni", "", "")
+	noSNI := flags.Bool("no-sni", false, "")
+	connect := flags.String("connect", "", "")
+	proxy := flags.String("proxy", "", "")
+	workers := flags.Int("workers", certmin.DefaultScanWorkers, "")
+	expiryWarning := flags.Int("expiry-warning", expiryDays, "")
+	allVariants := flags.Bool("all-variants", false, "")
+	allIPs := flags.Bool("all-ips", false, "")
+	timeout := flags.Duration("timeout", timeOut, "")
+	clientCertFile := flags.String("client-cert", "", "")
+	clientKeyFile := flags.String("client-key", "", "")
+	ldapServer := flags.String("ldap-server", "", "")
+	fileIssuers := flags.String("file-issuers", "", "")
+	passwordEnv := flags.String("password-env", "", "")
+	passwordFile := flags.String("password-file", "", "")
+	passwordFd := flags.String("password-fd", "", "")
+	keyPassword := flags.String("key-password", "", "")
+	certPassword := flags.String("cert-password", "", "")
 
 	err := flags.Parse(os.Args)
 	if err != nil {
@@ -100,6 +243,11 @@ func getAction() (actionFunc, string, error) {
 	}
 
 	all := append(*roots, *inters...)
+	for _, file := range []string{*clientCertFile, *clientKeyFile, *ctLogKey, *fileIssuers} {
+		if file != "" {
+			all = append(all, file)
+		}
+	}
 	var notFound []string
 	for _, cert := range all {
 		if _, err := os.Stat(cert); err != nil {
@@ -111,27 +259,112 @@ func getAction() (actionFunc, string, error) {
 	}
 
 	params := Params{
-		help:        *help,
-		progVersion: *progVersion,
-		leaf:        *leaf,
-		follow:      *follow,
-		noRoots:     *noRoots,
-		sort:        *sort,
-		rsort:       *rsort,
-		once:        *once,
-		keep:        *keep,
-		roots:       *roots,
-		inters:      *inters,
-	}
-	return verifyAndDispatch(params, flags.Args())
+		help:           *help,
+		progVersion:    *progVersion,
+		leaf:           *leaf,
+		follow:         *follow,
+		verbose:        *verbose,
+		quiet:          *quiet,
+		noComplete:     *noComplete,
+		download:       *download,
+		noRoots:        *noRoots,
+		sort:           *sort,
+		rsort:          *rsort,
+		once:           *once,
+		keep:           *keep,
+		roots:          *roots,
+		inters:         *inters,
+		ctLog:          *ctLog,
+		ctLogKey:       *ctLogKey,
+		digests:        *digests,
+		starttls:       *starttls,
+		sni:            *sni,
+		noSNI:          *noSNI,
+		connect:        *connect,
+		proxy:          *proxy,
+		workers:        *workers,
+		expiryWarning:  *expiryWarning,
+		allVariants:    *allVariants,
+		allIPs:         *allIPs,
+		timeout:        *timeout,
+		clientCertFile: *clientCertFile,
+		clientKeyFile:  *clientKeyFile,
+		ldapServer:     *ldapServer,
+		fileIssuers:    *fileIssuers,
+		passwordEnv:    *passwordEnv,
+		passwordFile:   *passwordFile,
+		passwordFd:     *passwordFd,
+		keyPassword:    *keyPassword,
+		certPassword:   *certPassword,
+	}
+	action, msg, err := verifyAndDispatch(params, flags.Args())
+	if !params.quiet {
+		return action, msg, err
+	}
+
+	// Only report through the exit status
+	if err != nil {
+		return nil, "", statusError(exitError)
+	}
+	if action != nil {
+		action = quietAction(action)
+	}
+	return action, msg, nil
+}
+
+// quietAction wraps an action to discard its output, with errors only reported
+// as a statusError.
+func quietAction(action actionFunc) actionFunc {
+	return func() (string, error) {
+		_, err := action()
+		var status statusError
+		if err != nil && !errors.As(err, &status) {
+			return "", statusError(exitError)
+		}
+		return "", err
+	}
+}
+
+// validPasswordSource returns true if the password source is pass:password,
+// env:VAR, file:path or fd:N.
+func validPasswordSource(source string) bool {
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return false
+	}
+	switch parts[0] {
+	case "pass", "env", "file":
+		return true
+	case "fd":
+		fd, err := strconv.Atoi(parts[1])
+		return err == nil && fd >= 0
+	default:
+		return false
+	}
+}
+
+// validStartTLS returns true if the StartTLS protocol is supported.
+func validStartTLS(protocol string) bool {
+	for _, supported := range certmin.StartTLSProtocols() {
+		if protocol == supported {
+			return true
+		}
+	}
+	return false
 }
 
-// verifyAndDispatch takes the cli parameters, verifies them
-// and returns an action to be run and an possible exit status.
+// verifyAndDispatch takes the cli parameters, verifies them, loads the client
+// certificate and returns an action to be run and an possible exit status.
 func verifyAndDispatch(params Params, args []string) (actionFunc, string, error) {
 	cmds := map[string]bool{
+		"ct":           true,
+		"ct-verify":    true,
 		"sc":           true,
+		"scan-tls":     true,
 		"skim":         true,
+		"st":           true,
+		"ti":           true,
+		"tls-info":     true,
 		"vc":           true,
 		"verify-chain": true,
 		"vk":           true,
@@ -144,6 +377,20 @@ func verifyAndDispatch(params Params, args []string) (actionFunc, string, error)
 		}
 	}
 
+	var invalidDigests []string
+	for _, digest := range params.digests {
+		if _, ok := digestNames[digest]; !ok {
+			invalidDigests = append(invalidDigests, digest)
+		}
+	}
+
+	var sharedPasswords int
+	for _, source := range []string{params.passwordEnv, params.passwordFile, params.passwordFd} {
+		if source != "" {
+			sharedPasswords++
+		}
+	}
+
 	switch {
 	case params.help:
 		return nil, usage, nil
@@ -153,14 +400,65 @@ func verifyAndDispatch(params Params, args []string) (actionFunc, string, error)
 		return nil, usage, nil
 	case invalidAction:
 		return nil, "", errors.New("invalid action")
+	case params.starttls != "" && !validStartTLS(params.starttls):
+		return nil, "", fmt.Errorf("invalid StartTLS protocol (%s)", params.starttls)
+	case len(invalidDigests) > 0:
+		return nil, "", fmt.Errorf("invalid digest (%s)", strings.Join(invalidDigests, ", "))
+	case params.clientKeyFile != "" && params.clientCertFile == "":
+		return nil, "", errors.New("--client-key requires --client-cert")
+	case params.sni != "" && params.noSNI:
+		return nil, "", errors.New("--sni and --no-sni are mutually exclusive")
+	case params.allVariants && params.allIPs:
+		return nil, "", errors.New("--all-variants and --all-ips are mutually exclusive")
+	case params.allIPs && params.connect != "":
+		return nil, "", errors.New("--all-ips and --connect are mutually exclusive")
+	case sharedPasswords > 1:
+		return nil, "", errors.New("--password-env, --password-file and --password-fd are mutually exclusive")
+	case params.passwordFd != "" && !validPasswordSource("fd:"+params.passwordFd):
+		return nil, "", errors.New("invalid file descriptor (--password-fd)")
+	case params.keyPassword != "" && !validPasswordSource(params.keyPassword):
+		return nil, "", errors.New("invalid password source (--key-password): use pass:, env:, file: or fd:")
+	case params.certPassword != "" && !validPasswordSource(params.certPassword):
+		return nil, "", errors.New("invalid password source (--cert-password): use pass:, env:, file: or fd:")
 	case params.leaf && params.follow:
 		return nil, "", errors.New("--leaf and --follow are mutually exclusive")
 	case params.sort && params.rsort:
 		return nil, "", errors.New("--sort and --rsort are mutually exclusive")
 	case params.once && !(params.sort || params.rsort):
 		return nil, "", errors.New("--once requires --sort and --rsort")
+	case params.expiryWarning < 0:
+		return nil, "", errors.New("--expiry-warning needs a number of days (0 or more)")
 	case len(args) < 3:
 		return nil, "", errors.New("no certificate location given")
+	case (args[1] == "ct-verify" || args[1] == "ct") && params.ctLog == "":
+		return nil, "", errors.New("ct-verify needs a log URL (--log)")
+	case (args[1] == "ct-verify" || args[1] == "ct") && params.ctLogKey == "":
+		return nil, "", errors.New("ct-verify needs the public key of the log (--log-key)")
+	case (args[1] == "verify-key" || args[1] == "vk") && len(args) < 4:
+		return nil, "", errors.New("verify-key needs 1 key file and at least 1 location")
+	}
+
+	// Only load the client certificate, which may need a password, once the
+	// parameters are valid
+	if !params.quiet &&
+		(strings.HasPrefix(params.keyPassword, "pass:") || strings.HasPrefix(params.certPassword, "pass:")) {
+		fmt.Fprintln(os.Stderr,
+			color.YellowString("WARNING: passwords given with pass: are visible to other users of the system"))
+	}
+	if params.clientCertFile != "" {
+		var err error
+		params.clientCert, err = loadClientCert(params.clientCertFile, params.clientKeyFile, params)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	switch {
+	case args[1] == "ct-verify" || args[1] == "ct":
+		return func() (string, error) { return ctVerify(args[2:], params) }, "", nil
+
+	case args[1] == "scan-tls" || args[1] == "st":
+		return func() (string, error) { return scanTLS(args[2:], params) }, "", nil
 
 	case args[1] == "skim" || args[1] == "sc":
 		// Add them quietly
@@ -169,11 +467,12 @@ func verifyAndDispatch(params Params, args []string) (actionFunc, string, error)
 		locs = append(locs, params.inters...)
 		return func() (string, error) { return skimCerts(locs, params) }, "", nil
 
+	case args[1] == "tls-info" || args[1] == "ti":
+		return func() (string, error) { return tlsInfo(args[2:], params) }, "", nil
+
 	case args[1] == "verify-chain" || args[1] == "vc":
 		return func() (string, error) { return verifyChain(args[2:], params) }, "", nil
 
-	case (args[1] == "verify-key" || args[1] == "vk") && len(args) < 4:
-		return nil, "", errors.New("verify-key needs 1 key file and at least 1 location")
 	case args[1] == "verify-key" || args[1] == "vk":
 		return func() (string, error) { return verifyKey(args[2], args[3:], params) }, "", nil
 
@@ -1,13 +1,86 @@
 package main
 
 import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/nxadm/certmin/internal/testcert"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestGetAction(t *testing.T) {
-	t.SkipNow()
+	dir, err := ioutil.TempDir("", "certmin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root, rootKey := testcert.Issued(t, "root", true, nil, nil)
+	leaf, _ := testcert.Issued(t, "leaf", false, root, rootKey) // valid for an hour
+	other, _ := testcert.Issued(t, "other", true, nil, nil)
+	for name, cert := range map[string]*x509.Certificate{"leaf.crt": leaf, "other.crt": other} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), cert.Raw, 0600))
+	}
+	args := os.Args
+	defer func() { os.Args = args }()
+
+	// --quiet only sets the exit status
+	os.Args = []string{"certmin", "verify-chain", "--quiet", "--expiry-warning=0",
+		"--root=" + filepath.Join(dir, "other.crt"), filepath.Join(dir, "leaf.crt")}
+	action, _, err := getAction()
+	if assert.NoError(t, err) && assert.NotNil(t, action) {
+		output, err := action()
+		assert.Empty(t, output)
+		assert.Equal(t, statusError(exitFailed), err)
+	}
+
+	os.Args = []string{"certmin", "skim", "-q", filepath.Join(dir, "leaf.crt")} // expires within 30 days
+	action, _, err = getAction()
+	if assert.NoError(t, err) && assert.NotNil(t, action) {
+		output, err := action()
+		assert.Empty(t, output)
+		assert.Equal(t, statusError(exitWarning), err)
+	}
+
+	os.Args = []string{"certmin", "skim", "--expiry-warning=-1", filepath.Join(dir, "leaf.crt")}
+	_, _, err = getAction()
+	assert.Error(t, err)
+
+	// Errors are only reported through the exit status with --quiet, also on stderr
+	stderr := os.Stderr
+	defer func() { os.Stderr = stderr }()
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	os.Stderr = w
+	os.Args = []string{"certmin", "skim", "-q", "--expiry-warning=-1", filepath.Join(dir, "leaf.crt")}
+	_, _, err = getAction()
+	assert.Equal(t, statusError(exitError), err)
+	os.Args = []string{"certmin", "skim", "-q", "--key-password=pass:secret", filepath.Join(dir, "missing.crt")}
+	action, _, err = getAction()
+	if assert.NoError(t, err) && assert.NotNil(t, action) {
+		output, err := action()
+		assert.Empty(t, output)
+		assert.Equal(t, statusError(exitError), err)
+	}
+	w.Close()
+	os.Stderr = stderr
+	written, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Empty(t, string(written))
+}
+
+func TestValidPasswordSource(t *testing.T) {
+	for _, source := range []string{"pass:secret", "pass:a:b", "env:PASSWORD", "file:/tmp/password", "fd:3"} {
+		assert.True(t, validPasswordSource(source), source)
+	}
+	for _, source := range []string{"", "secret", "pass:", "fd:-1", "fd:three", "stdin:"} {
+		assert.False(t, validPasswordSource(source), source)
+	}
+}
+
+func TestValidStartTLS(t *testing.T) {
+	assert.True(t, validStartTLS("smtp"))
+	assert.False(t, validStartTLS("smtps"))
 }
 
 func TestVerifyAndDispatch(t *testing.T) {
@@ -69,12 +142,94 @@ func TestVerifyAndDispatch(t *testing.T) {
 	params.sort = false
 	params.rsort = false
 
+	params.digests = []string{"sha256", "md5"}
+	action, msg, err = verifyAndDispatch(params, []string{"certmin", "skim", "foo"})
+	assert.Nil(t, action)
+	assert.NotNil(t, err)
+	params.digests = nil
+
+	params.starttls = "foo"
+	action, msg, err = verifyAndDispatch(params, []string{"certmin", "skim", "foo"})
+	assert.Nil(t, action)
+	assert.NotNil(t, err)
+	params.starttls = ""
+
+	params.sni = "foo"
+	params.noSNI = true
+	action, msg, err = verifyAndDispatch(params, []string{"certmin", "skim", "foo"})
+	assert.Nil(t, action)
+	assert.NotNil(t, err)
+	params.sni = ""
+	params.noSNI = false
+
+	// illegal --all-ips combinations
+	params.allIPs = true
+	params.allVariants = true
+	action, msg, err = verifyAndDispatch(params, []string{"certmin", "skim", "foo"})
+	assert.Nil(t, action)
+	assert.NotNil(t, err)
+	params.allVariants = false
+	params.connect = "192.0.2.1"
+	action, msg, err = verifyAndDispatch(params, []string{"certmin", "skim", "foo"})
+	assert.Nil(t, action)
+	assert.NotNil(t, err)
+	params.allIPs = false
+	params.connect = ""
+
+	// client key without client certificate
+	params.clientKeyFile = "t/myserver.key"
+	action, msg, err = verifyAndDispatch(params, []string{"certmin", "skim", "foo"})
+	assert.Nil(t, action)
+	assert.NotNil(t, err)
+	params.clientKeyFile = ""
+
+	// illegal password options, rejected before reading the client certificate
+	params.passwordEnv = "PASSWORD"
+	params.passwordFile = "password.txt"
+	params.clientCertFile = "t/myserver.pfx"
+	action, msg, err = verifyAndDispatch(params, []string{"certmin", "skim", "foo"})
+	assert.Nil(t, action)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "mutually exclusive")
+	}
+	params.passwordFile = ""
+	params.passwordEnv = ""
+	params.clientCertFile = ""
+
+	for _, source := range []string{"secret", "fd:foo", "env:"} {
+		params.certPassword = source
+		action, msg, err = verifyAndDispatch(params, []string{"certmin", "skim", "foo"})
+		assert.Nil(t, action)
+		if assert.NotNil(t, err, source) {
+			assert.NotContains(t, err.Error(), "secret")
+		}
+	}
+	params.certPassword = ""
+
 	// illegal verify key
 	action, msg, err = verifyAndDispatch(params, []string{"certmin", "verify-key", "foo"})
 	assert.Nil(t, action)
 	assert.NotNil(t, err)
 
+	// ct-verify without log
+	action, msg, err = verifyAndDispatch(params, []string{"certmin", "ct-verify", "foo"})
+	assert.Nil(t, action)
+	assert.NotNil(t, err)
+
+	// ct-verify without log key
+	params.ctLog = "https://ct.example.com"
+	action, msg, err = verifyAndDispatch(params, []string{"certmin", "ct-verify", "foo"})
+	assert.Nil(t, action)
+	assert.NotNil(t, err)
+
 	// legal actions
+	params.ctLogKey = "t/ct-log.pub"
+	action, msg, err = verifyAndDispatch(params, []string{"certmin", "ct-verify", "foo"})
+	assert.NotNil(t, action)
+	assert.Nil(t, err)
+	params.ctLog = ""
+	params.ctLogKey = ""
+
 	action, msg, err = verifyAndDispatch(params, []string{"certmin", "skim", "foo", "bar"})
 	assert.NotNil(t, action)
 	assert.Nil(t, err)
@@ -94,4 +249,12 @@ func TestVerifyAndDispatch(t *testing.T) {
 	action, msg, err = verifyAndDispatch(params, []string{"certmin", "verify-key", "foo", "bar"})
 	assert.NotNil(t, action)
 	assert.Nil(t, err)
+
+	params.clientCertFile = "t/myserver.pfx"
+	params.certPassword = "pass:1234"
+	action, msg, err = verifyAndDispatch(params, []string{"certmin", "skim", "foo"})
+	assert.NotNil(t, action)
+	assert.Nil(t, err)
+	params.clientCertFile = ""
+	params.certPassword = ""
 }
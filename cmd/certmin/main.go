@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -9,30 +10,45 @@ import (
 )
 
 const (
-	version = "0.5.11"
-	website = "https://github.com/nxadm/certmin"
-	timeOut = 5 * time.Second
+	version    = "0.5.11"
+	website    = "https://github.com/nxadm/certmin"
+	timeOut    = 5 * time.Second
+	expiryDays = 30 // default of --expiry-warning
+)
+
+// Exit statuses
+const (
+	exitOK      = 0
+	exitError   = 1 // operational error
+	exitFailed  = 2 // verification failure
+	exitWarning = 3 // e.g. hostname mismatch
 )
 
 func main() {
+	var status statusError
 	action, msg, err := getAction()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %s\n", err)
-		os.Exit(1)
+		if !errors.As(err, &status) { // not with --quiet
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		}
+		os.Exit(exitError)
 	}
 	if action == nil {
 		fmt.Println(msg)
-		os.Exit(0)
+		os.Exit(exitOK)
 	}
 
 	output, err := action()
 	if output != "" {
 		fmt.Println(output)
 	}
-	if err != nil {
+	switch {
+	case err == nil:
+		os.Exit(exitOK)
+	case errors.As(err, &status):
+		os.Exit(int(status))
+	default:
 		fmt.Fprintf(os.Stderr, color.RedString("error: %s\n"), err)
-		os.Exit(1)
-	} else {
-		os.Exit(0)
+		os.Exit(exitError)
 	}
 }
@@ -1,18 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
-	"net"
-	"net/url"
 	"os"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -25,6 +30,47 @@ import (
 // Compile the regex once
 var rxNormalize = regexp.MustCompile("[^a-zA-Z0-9_-]")
 
+// issuerCache shares the certificates retrieved from Issuing Certificate URLs
+// between the locations
+var issuerCache = certmin.NewIssuerCache()
+
+// passwords caches the passwords read from their sources, as e.g. a file
+// descriptor can only be read once
+var passwords = make(map[string]string)
+
+// stdinLocation is the location of certificates and keys read from stdin
+const stdinLocation = "-"
+
+// stdin is read once, as several locations may refer to it (e.g. a key and a
+// certificate)
+var (
+	stdin      io.Reader = os.Stdin
+	stdinBytes []byte
+	stdinErr   error
+	stdinOnce  sync.Once
+)
+
+// digestNames are the digests that can be requested with --digest
+var digestNames = map[string]bool{"none": true, "sha1": true, "sha256": true, "spki": true}
+
+// sanLabels are the labels of the subject alternative names not shown
+// through crypto/x509
+var sanLabels = map[string]string{
+	"otherName":     "Other names",
+	"directoryName": "Directory names",
+	"registeredID":  "Registered IDs",
+	"x400Address":   "X400 addresses",
+	"ediPartyName":  "EDI party names",
+}
+
+// certGroup is a chain of a location with the handshakes or IP addresses
+// (sources, described by label) that returned it.
+type certGroup struct {
+	label   string
+	sources []string
+	chain   []*x509.Certificate
+}
+
 // colourKeeper keeps track of certain output that must have the same color.
 // e.g. the CN as Subject and Issuer.
 type colourKeeper map[string]int
@@ -56,7 +102,7 @@ func appendToCertTree(inTree []*x509.Certificate, toAdd []string) ([]*x509.Certi
 	if toAdd != nil {
 		var certs []*x509.Certificate
 		for _, file := range toAdd {
-			tmpCerts, err := certmin.DecodeCertFile(file, "")
+			tmpCerts, err := decodeCerts(file, "")
 			if err != nil {
 				return nil, err
 			}
@@ -67,34 +113,141 @@ func appendToCertTree(inTree []*x509.Certificate, toAdd []string) ([]*x509.Certi
 	return certmin.SortCerts(inTree, false), nil
 }
 
+// bytesAsHex converts a []byte to a hex string with ":" every 2 characters.
+func bytesAsHex(bytes []byte) string {
+	buf := make([]byte, 0, 3*len(bytes))
+	hexRecipient := buf[1*len(bytes) : 3*len(bytes)]
+	hex.Encode(hexRecipient, bytes)
+	for i := 0; i < len(hexRecipient); i += 2 {
+		buf = append(buf, hexRecipient[i], hexRecipient[i+1], ':')
+	}
+	return string(buf[:len(buf)-1])
+}
+
+// certPassword returns the password of PKCS12 certificate files from
+// --cert-password or the shared password options, or prompts for it.
+func certPassword(params Params) (string, error) {
+	if params.certPassword != "" {
+		return readPassword(params.certPassword)
+	}
+	return sharedPassword(params)
+}
+
+// completeChain retrieves the issuers missing from the certificates from the
+// Issuing Certificate URLs, showing the requests if requested with --verbose.
+func completeChain(certs []*x509.Certificate, w io.Writer, params Params) ([]*x509.Certificate, error) {
+	completed, hops, err := urlClient(params).CompleteChain(context.Background(), certs, retrieveOptions(params))
+	if params.verbose {
+		printIssuerHops(hops, w)
+	}
+	return completed, err
+}
+
+// decodeCerts decodes the certificates of a file or, if the file is "-", of
+// stdin. Private keys in PEM data are skipped.
+func decodeCerts(file, password string) ([]*x509.Certificate, error) {
+	if file != stdinLocation {
+		return certmin.DecodeCertFile(file, password)
+	}
+	data, err := readStdin()
+	if err != nil {
+		return nil, err
+	}
+	_, certBytes := splitPEM(data)
+	return certmin.DecodeCertBytes(certBytes, password)
+}
+
+// decodeKey decodes the key of a file or, if the file is "-", of stdin.
+// Certificates in PEM data are skipped.
+func decodeKey(file, password string) (*pem.Block, error) {
+	if file != stdinLocation {
+		return certmin.DecodeKeyFile(file, password)
+	}
+	data, err := readStdin()
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, _ := splitPEM(data)
+	return certmin.DecodeKeyBytes(keyBytes, password)
+}
+
+// fileIssuersHint returns the message of an error following the Issuing
+// Certificate URLs, suggesting --file-issuers for a refused file:// URL.
+func fileIssuersHint(err error) string {
+	if errors.Is(err, certmin.ErrFileIssuerURLNotAllowed) {
+		return err.Error() + ", use --file-issuers=dir to read it from a local mirror"
+	}
+	return err.Error()
+}
+
+// findIssuer returns the certificate that signed cert within certs, or nil
+// if not found.
+func findIssuer(cert *x509.Certificate, certs []*x509.Certificate) *x509.Certificate {
+	for _, candidate := range certs {
+		if candidate == cert || candidate.Subject.String() != cert.Issuer.String() {
+			continue
+		}
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// followIssuers retrieves the chain of a certificate from the Issuing
+// Certificate URLs, showing the requests if requested with --verbose. A refused
+// file:// URL is reported as a warning on the report, with the chain found so far.
+func followIssuers(
+	cert *x509.Certificate, w io.Writer, sb *report, params Params) ([]*x509.Certificate, error) {
+	chain, hops, err := urlClient(params).RetrieveChainWithTrace(context.Background(), cert, retrieveOptions(params))
+	if params.verbose {
+		printIssuerHops(hops, w)
+	}
+	if errors.Is(err, certmin.ErrFileIssuerURLNotAllowed) {
+		fmt.Fprint(w, color.YellowString("WARNING: "+fileIssuersHint(err)+"\n\n"))
+		sb.raise(exitWarning)
+		return chain, nil
+	}
+	return chain, err
+}
+
 // getCerts does the optional downloading and parsing of certificates
-func getCerts(input string, sb *strings.Builder) ([]*x509.Certificate, error) {
+func getCerts(input string, sb *report, params Params) ([]*x509.Certificate, error) {
 	var certs []*x509.Certificate
-	var err, warn error
 
-	loc, remote, err := getLocation(input)
+	loc, err := parseLocation(input, params)
 	if err != nil {
 		return nil, err
 	}
 
-	if remote {
-		certs, warn, err = certmin.RetrieveCertsFromAddr(loc, timeOut)
-		if warn != nil {
-			sb.WriteString(color.YellowString("WARNING: " + warn.Error()) + "\n\n")
+	if loc.IsRemote() {
+		options := retrieveOptions(params)
+		if options.StartTLS == "" {
+			options.StartTLS = loc.StartTLS
+		}
+		result, err := certmin.RetrieveCerts(loc.Addr(), options)
+		if err != nil {
+			return nil, err
+		}
+		if warn := result.Warning(); warn != nil {
+			sb.warn(warningMsg(warn) + "\n\n")
 		}
+		certs = result.PeerCertificates
+	} else if loc.IsDownload() {
+		certs, err = urlClient(params).DownloadCerts(context.Background(), loc.URL, retrieveOptions(params))
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		certs, err = certmin.DecodeCertFile(loc, "")
+		certs, err = decodeCerts(loc.File, "")
 		if err != nil {
 			if strings.Contains(err.Error(), "pkcs12: decryption password incorrect") {
-				passwordBytes, err := promptForKeyPassword()
+				password, err := certPassword(params)
 				if err != nil {
 					return nil, err
 				}
 
-				certs, err = certmin.DecodeCertFile(loc, string(passwordBytes))
+				certs, err = decodeCerts(loc.File, password)
 				if err != nil {
 					return nil, err
 				}
@@ -106,72 +259,162 @@ func getCerts(input string, sb *strings.Builder) ([]*x509.Certificate, error) {
 	return certs, nil
 }
 
-// getLocation parses an input string and it return a string with a file
-// name or a rewritten hostname:port location, a boolean stating if the
-// location is remote and an error.
-func getLocation(input string) (string, bool, error) {
-	// Local file
-	_, err := os.Stat(input)
-	if err == nil {
-		return input, false, nil
+// getCertGroups returns the certificates of a location as a single group or,
+// if requested with --all-variants or --all-ips, every distinct chain offered
+// by a remote location.
+func getCertGroups(input string, sb *report, params Params) ([]certGroup, error) {
+	loc, err := parseLocation(input, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if !(params.allVariants || params.allIPs) || !loc.IsRemote() {
+		certs, err := getCerts(input, sb, params)
+		if err != nil {
+			return nil, err
+		}
+		return []certGroup{{chain: certs}}, nil
 	}
 
-	// Remote
-	location, err := parseURL(input)
-	if err == nil {
-		return location, true, nil
+	options := retrieveOptions(params)
+	if options.StartTLS == "" {
+		options.StartTLS = loc.StartTLS
 	}
-	location, err = parseURL("certmin://" + input) // Add a scheme
-	if err == nil {
-		return location, true, nil
+	if params.allIPs {
+		return getIPGroups(loc, sb, options)
 	}
 
-	return "", false, fmt.Errorf("%s is not a file or a remote location", input)
+	variants, err := certmin.RetrieveCertVariants(loc.Addr(), options)
+	if err != nil {
+		return nil, err
+	}
+	var groups []certGroup
+	for _, variant := range variants {
+		groups = append(groups, certGroup{label: "Handshakes", sources: variant.Handshakes, chain: variant.Chain})
+	}
+	return groups, nil
 }
 
-// parseURL parses a given URL and return a string in the form of
-// hostname:port or an error if the parsing fails.
-func parseURL(remote string) (string, error) {
-	parsedURL, err := url.Parse(remote)
+// getIPGroups returns the distinct chains served by the IP addresses of a
+// remote location, warning about addresses that fail or serve differing chains.
+func getIPGroups(loc *certmin.Location, sb *report, options *certmin.RetrieveOptions) ([]certGroup, error) {
+	results, err := certmin.RetrieveCertsFromAllIPs(loc.Addr(), options)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	host := parsedURL.Host
-	if host == "" {
-		return "", errors.New("no hostname found")
+	var groups []certGroup
+	var lastErr error
+	for _, ipCerts := range results {
+		ip := ipCerts.IP.String()
+		if ipCerts.Err != nil {
+			sb.WriteString(color.RedString("error: "+ip+": "+ipCerts.Err.Error()) + "\n\n")
+			sb.raise(exitError)
+			lastErr = ipCerts.Err
+			continue
+		}
+		if warn := ipCerts.Result.Warning(); warn != nil {
+			sb.warn(ip + ": " + warningMsg(warn) + "\n\n")
+		}
+		if ipCerts.Variant == len(groups) {
+			groups = append(groups, certGroup{label: "Addresses", chain: ipCerts.Result.PeerCertificates})
+		}
+		groups[ipCerts.Variant].sources = append(groups[ipCerts.Variant].sources, ip)
 	}
 
-	scheme := parsedURL.Scheme
-	portStr := parsedURL.Port()
-	var port int
-	if portStr == "" {
-		foundPort, err := net.LookupPort("tcp", scheme)
-		if err == nil {
-			port = foundPort
-		} else {
-			port = 443
+	switch {
+	case len(groups) == 0:
+		return nil, lastErr
+	case len(groups) > 1:
+		msg := fmt.Sprintf("WARNING: the IP addresses of %s serve %d different certificate chains",
+			loc.Host, len(groups))
+		sb.warn(msg + "\n\n")
+	}
+	return groups, nil
+}
+
+// keyPassword returns the password of encrypted keys from --key-password or
+// the shared password options, or prompts for it.
+func keyPassword(params Params) (string, error) {
+	if params.keyPassword != "" {
+		return readPassword(params.keyPassword)
+	}
+	return sharedPassword(params)
+}
+
+// loadClientCert decodes a client certificate and its key, prompting for a
+// password if needed. The key is read from the certificate file (e.g. PKCS12)
+// if no key file is given.
+func loadClientCert(certFile, keyFile string, params Params) (*tls.Certificate, error) {
+	var password string
+	certs, err := certmin.DecodeCertFile(certFile, "")
+	if err != nil && strings.Contains(err.Error(), "pkcs12: decryption password incorrect") {
+		password, err = certPassword(params)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		port, err = strconv.Atoi(portStr) // prefer explicit port
+		certs, err = certmin.DecodeCertFile(certFile, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	key, err := certmin.DecodeKeyFile(keyFile, password)
+	if err != nil {
+		password, err = keyPassword(params)
 		if err != nil {
-			return "", fmt.Errorf("invalid port (%s)", portStr)
+			return nil, err
+		}
+		key, err = certmin.DecodeKeyFile(keyFile, password)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return parsedURL.Hostname() + ":" + strconv.Itoa(port), nil
+	return certmin.ClientCertificate(certs, key)
 }
 
-// printCert prints the relevant information of certificate
-func printCert(cert *x509.Certificate, w *tabwriter.Writer, colourKeeper colourKeeper) {
+// parseLocation parses a location, as a file to download if requested with
+// --download for HTTP(S) URLs and as stdin for "-"
+func parseLocation(input string, params Params) (*certmin.Location, error) {
+	if input == stdinLocation {
+		return &certmin.Location{File: stdinLocation}, nil
+	}
+	lower := strings.ToLower(input)
+	if params.download && (strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")) {
+		input = "get+" + input
+	}
+	return certmin.ParseLocation(input)
+}
+
+// printCert prints the relevant information of certificate, including the
+// requested digests (sha1, sha256 and/or spki).
+func printCert(cert *x509.Certificate, w *tabwriter.Writer, colourKeeper colourKeeper, digests []string) {
 	fmt.Fprintf(w, "Subject:\t%s\n", colourKeeper.colourise(cert.Subject.String()))
 	fmt.Fprintf(w, "Issuer:\t%s\n", colourKeeper.colourise(cert.Issuer.String()))
 	if len(cert.IssuingCertificateURL) > 0 {
 		fmt.Fprintf(w, "Issuer Certificate URLs:\t%s\n",
 			strings.Join(cert.IssuingCertificateURL, ", "))
 	}
+	desc := certmin.DescribeCert(cert)
 	if len(cert.DNSNames) > 0 {
-		fmt.Fprintf(w, "DNS names:\t%s\n", strings.Join(cert.DNSNames, ", "))
+		unicode := make(map[string]string)
+		for _, name := range desc.SubjectAltNames {
+			if name.Unicode != "" {
+				unicode[name.Value] = name.Unicode
+			}
+		}
+		var names []string
+		for _, name := range cert.DNSNames {
+			if _, ok := unicode[name]; ok {
+				name += " (" + unicode[name] + ")"
+			}
+			names = append(names, name)
+		}
+		fmt.Fprintf(w, "DNS names:\t%s\n", strings.Join(names, ", "))
 	}
 	if len(cert.EmailAddresses) > 0 {
 		fmt.Fprintf(w, "Email addresses:\t%s\n", strings.Join(cert.EmailAddresses, ", "))
@@ -190,8 +433,36 @@ func printCert(cert *x509.Certificate, w *tabwriter.Writer, colourKeeper colourK
 		}
 		fmt.Fprintf(w, "URIs:\t%s\n", strings.Join(uris, ", "))
 	}
+	otherSANs := make(map[string][]string)
+	for _, name := range desc.SubjectAltNames {
+		switch name.Type {
+		case "otherName":
+			label := name.Name
+			if label == "" {
+				label = name.OID
+			}
+			otherSANs[name.Type] = append(otherSANs[name.Type], label+": "+name.Value)
+		case "directoryName", "registeredID", "x400Address", "ediPartyName":
+			otherSANs[name.Type] = append(otherSANs[name.Type], name.Value)
+		}
+	}
+	for _, sanType := range []string{"otherName", "directoryName", "registeredID", "x400Address", "ediPartyName"} {
+		if len(otherSANs[sanType]) > 0 {
+			fmt.Fprintf(w, "%s:\t%s\n", sanLabels[sanType], strings.Join(otherSANs[sanType], ", "))
+		}
+	}
 
 	fmt.Fprintf(w, "Serial number:\t%s\n", serialAsHex(cert.SerialNumber))
+	for _, digest := range digests {
+		switch digest {
+		case "sha1":
+			fmt.Fprintf(w, "SHA-1 fingerprint:\t%s\n", bytesAsHex(certmin.FingerprintSHA1(cert)))
+		case "sha256":
+			fmt.Fprintf(w, "SHA-256 fingerprint:\t%s\n", bytesAsHex(certmin.FingerprintSHA256(cert)))
+		case "spki":
+			fmt.Fprintf(w, "SPKI SHA-256 pin:\t%s\n", certmin.SPKIPinSHA256(cert))
+		}
+	}
 	fmt.Fprintf(w, "Version:\t%d\n", cert.Version)
 
 	if cert.IsCA {
@@ -204,7 +475,65 @@ func printCert(cert *x509.Certificate, w *tabwriter.Writer, colourKeeper colourK
 		fmt.Fprintf(w, "MaxPathLen is 0:\t%t\n", cert.MaxPathLenZero)
 	}
 	fmt.Fprintf(w, "Public key algorithm:\t%s\n", cert.PublicKeyAlgorithm.String())
+	if desc.PublicKey != nil {
+		switch {
+		case desc.PublicKey.Exponent != 0:
+			fmt.Fprintf(w, "Public key:\t%d bits, exponent %d\n", desc.PublicKey.Bits, desc.PublicKey.Exponent)
+		case desc.PublicKey.Curve != "":
+			fmt.Fprintf(w, "Public key:\t%s (%d bits)\n", desc.PublicKey.Curve, desc.PublicKey.Bits)
+		default:
+			fmt.Fprintf(w, "Public key:\t%d bits\n", desc.PublicKey.Bits)
+		}
+		fmt.Fprintf(w, "Security level:\t%d bits (%s)\n", desc.PublicKey.SecurityLevel, desc.PublicKey.Strength)
+	}
 	fmt.Fprintf(w, "Signature algorithm:\t%s\n", cert.SignatureAlgorithm.String())
+
+	if len(desc.KeyUsage) > 0 {
+		fmt.Fprintf(w, "Key usage:\t%s\n", strings.Join(desc.KeyUsage, ", "))
+	}
+	if len(desc.ExtKeyUsage) > 0 {
+		fmt.Fprintf(w, "Extended key usage:\t%s\n", strings.Join(desc.ExtKeyUsage, ", "))
+	}
+	if len(desc.SubjectKeyID) > 0 {
+		fmt.Fprintf(w, "Subject key ID:\t%s\n", bytesAsHex(desc.SubjectKeyID))
+	}
+	if len(desc.AuthorityKeyID) > 0 {
+		fmt.Fprintf(w, "Authority key ID:\t%s\n", bytesAsHex(desc.AuthorityKeyID))
+	}
+	if len(desc.Policies) > 0 {
+		var policies []string
+		for _, policy := range desc.Policies {
+			policyStr := policy.OID
+			if policy.Name != "" {
+				policyStr += " (" + policy.Name + ")"
+			}
+			for _, cps := range policy.CPS {
+				policyStr += " [CPS: " + cps + "]"
+			}
+			for _, notice := range policy.UserNotices {
+				policyStr += " [Notice: " + notice + "]"
+			}
+			policies = append(policies, policyStr)
+		}
+		fmt.Fprintf(w, "Policies:\t%s\n", strings.Join(policies, ", "))
+	}
+	if len(desc.TLSFeatures) > 0 {
+		fmt.Fprintf(w, "TLS features:\t%s\n", strings.Join(desc.TLSFeatures, ", "))
+	}
+	if len(desc.Extensions) > 0 {
+		var exts []string
+		for _, ext := range desc.Extensions {
+			extStr := ext.Name
+			if extStr == "" {
+				extStr = ext.OID + " (unrecognised)"
+			}
+			if ext.Critical {
+				extStr += " (critical)"
+			}
+			exts = append(exts, extStr)
+		}
+		fmt.Fprintf(w, "Extensions:\t%s\n", strings.Join(exts, ", "))
+	}
 	if cert.PermittedDNSDomainsCritical {
 		fmt.Fprintf(w, "Permitted DNS domains critical:\t%t\n", true)
 	}
@@ -250,6 +579,52 @@ func printCert(cert *x509.Certificate, w *tabwriter.Writer, colourKeeper colourK
 	fmt.Fprintf(w, "Not after:\t%s\n", cert.NotAfter)
 }
 
+// printHandshakeInfo prints the details of a TLS handshake.
+func printHandshakeInfo(info *certmin.HandshakeInfo, w *tabwriter.Writer) {
+	yesNo := map[bool]string{false: "no", true: "yes"}
+	orNone := func(value string) string {
+		if value == "" {
+			return "none"
+		}
+		return value
+	}
+
+	fmt.Fprintf(w, "Protocol version:\t%s\n", info.VersionName())
+	fmt.Fprintf(w, "Cipher suite:\t%s\n", info.CipherSuiteName())
+	fmt.Fprintf(w, "Key exchange group:\t%s\n", orNone(info.KeyExchangeGroupName()))
+	fmt.Fprintf(w, "ALPN protocol:\t%s\n", orNone(info.NegotiatedProtocol))
+	fmt.Fprintf(w, "SNI:\t%s\n", orNone(info.ServerName))
+	fmt.Fprintf(w, "Session resumption:\t%s\n", yesNo[info.DidResume])
+	fmt.Fprintf(w, "OCSP stapling:\t%s\n", yesNo[info.OCSPStapled()])
+	fmt.Fprintf(w, "Client certificate requested:\t%s\n", yesNo[info.ClientCertRequested])
+	if info.ClientCertSent {
+		fmt.Fprintf(w, "Client certificate accepted:\t%s\n", yesNo[info.ClientCertAccepted])
+	}
+	for _, name := range info.AcceptableCAs {
+		fmt.Fprintf(w, "Acceptable client CA:\t%s\n", name)
+	}
+}
+
+// printIssuerHops prints the requests for the Issuing Certificate URLs
+func printIssuerHops(hops []certmin.IssuerHop, w io.Writer) {
+	for _, hop := range hops {
+		fmt.Fprintf(w, "Issuer of %s: %s\n", hop.Subject, hop.URL)
+		switch {
+		case hop.Err != nil:
+			fmt.Fprintln(w, "  "+color.RedString("error: "+hop.Err.Error()))
+		case hop.Cached:
+			fmt.Fprintf(w, "  cached, %d certificate(s)\n", len(hop.Certs))
+		case hop.ContentType == "": // LDAP or file
+			fmt.Fprintf(w, "  %d certificate(s)\n", len(hop.Certs))
+		default:
+			fmt.Fprintf(w, "  %s, %d certificate(s)\n", hop.ContentType, len(hop.Certs))
+		}
+	}
+	if len(hops) > 0 {
+		fmt.Fprintln(w)
+	}
+}
+
 // promptForKeyPassword prompts the user for the password to
 // decrypt a private key. It returns the password string and
 // an error.
@@ -263,16 +638,161 @@ func promptForKeyPassword() (string, error) {
 	return string(bytePassword), nil
 }
 
+// readPassword returns the password of a source (pass:password, env:VAR,
+// file:path or fd:N). Only the first line of files is used.
+func readPassword(source string) (string, error) {
+	if password, ok := passwords[source]; ok {
+		return password, nil
+	}
+
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("invalid password source")
+	}
+	var password string
+	switch parts[0] {
+	case "pass":
+		password = parts[1]
+	case "env":
+		var ok bool
+		password, ok = os.LookupEnv(parts[1])
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", parts[1])
+		}
+	case "file", "fd":
+		var r io.Reader
+		if parts[0] == "file" {
+			file, err := os.Open(parts[1])
+			if err != nil {
+				return "", err
+			}
+			defer file.Close()
+			r = file
+		} else {
+			fd, err := strconv.Atoi(parts[1])
+			if err != nil || fd < 0 {
+				return "", fmt.Errorf("invalid file descriptor (%s)", parts[1])
+			}
+			r = os.NewFile(uintptr(fd), "fd:"+parts[1])
+		}
+		line, err := bufio.NewReader(r).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("can not read the password from %s: %s", source, err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	default:
+		return "", errors.New("invalid password source")
+	}
+
+	passwords[source] = password
+	return password, nil
+}
+
+// readStdin returns the data read from stdin, reading it on the first call
+func readStdin() ([]byte, error) {
+	stdinOnce.Do(func() {
+		stdinBytes, stdinErr = ioutil.ReadAll(stdin)
+		if stdinErr == nil && len(stdinBytes) == 0 {
+			stdinErr = errors.New("no data on stdin")
+		}
+	})
+	return stdinBytes, stdinErr
+}
+
+// retrieveOptions returns the options for remote retrievals set by the cli
+// parameters
+func retrieveOptions(params Params) *certmin.RetrieveOptions {
+	return &certmin.RetrieveOptions{
+		Timeout:    params.timeout,
+		StartTLS:   params.starttls,
+		ServerName: params.sni,
+		NoSNI:      params.noSNI,
+		ConnectTo:  params.connect,
+		Proxy:      params.proxy,
+
+		ClientCertificate: params.clientCert,
+	}
+}
+
 // serialAsHex converts a *big.Int Serial to a hex string with ":" every 2 characters.
 func serialAsHex(serial *big.Int) string {
-	bytes := serial.Bytes()
-	buf := make([]byte, 0, 3*len(bytes))
-	hexRecipient := buf[1*len(bytes) : 3*len(bytes)]
-	hex.Encode(hexRecipient, bytes)
-	for i := 0; i < len(hexRecipient); i += 2 {
-		buf = append(buf, hexRecipient[i], hexRecipient[i+1], ':')
+	return bytesAsHex(serial.Bytes())
+}
+
+// sharedPassword returns the password from --password-env, --password-file
+// or --password-fd, or prompts for it.
+func sharedPassword(params Params) (string, error) {
+	switch {
+	case params.passwordEnv != "":
+		return readPassword("env:" + params.passwordEnv)
+	case params.passwordFile != "":
+		return readPassword("file:" + params.passwordFile)
+	case params.passwordFd != "":
+		return readPassword("fd:" + params.passwordFd)
+	default:
+		return promptForKeyPassword()
 	}
-	return string(buf[:len(buf)-1])
+}
+
+// splitPEM separates the private keys of PEM data from the other blocks, so a
+// key and its certificate can be read together. Other data is returned as is
+// for both.
+func splitPEM(data []byte) ([]byte, []byte) {
+	var keyBytes, otherBytes []byte
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if strings.Contains(block.Type, "PRIVATE KEY") {
+			keyBytes = append(keyBytes, pem.EncodeToMemory(block)...)
+		} else {
+			otherBytes = append(otherBytes, pem.EncodeToMemory(block)...)
+		}
+	}
+	if keyBytes == nil && otherBytes == nil {
+		return data, data
+	}
+	return keyBytes, otherBytes
+}
+
+// urlClient returns the client retrieving certificates from URLs: downloads and
+// Issuing Certificate URLs
+func urlClient(params Params) *certmin.Client {
+	return certmin.NewClient(certmin.WithTimeout(params.timeout), certmin.WithIssuerCache(issuerCache),
+		certmin.WithLDAPServer(params.ldapServer), certmin.WithFileIssuerURLs(params.fileIssuers))
+}
+
+// verifyCertChain verifies the chain of the certificates with the roots and
+// intermediates given as files. The fetched certificates are only trusted as
+// intermediates.
+func verifyCertChain(certs, fetched []*x509.Certificate, params Params) (bool, error) {
+	tree := certmin.SplitCertsAsTree(certs)
+	roots, err := appendToCertTree(tree.Roots, params.roots)
+	if err != nil {
+		return false, err
+	}
+	tree.Roots = roots
+	inters, err := appendToCertTree(tree.Intermediates, params.inters)
+	if err != nil {
+		return false, err
+	}
+	tree.Intermediates = append(inters, fetched...)
+
+	verified, _ := certmin.VerifyChain(tree)
+	return verified, nil
+}
+
+// warningMsg returns the message of a retrieval warning, including the kind of
+// verification error if known.
+func warningMsg(warn error) string {
+	var verifyErr *certmin.VerificationError
+	if errors.As(warn, &verifyErr) {
+		return "WARNING: " + verifyErr.Kind.String() + " (" + verifyErr.Error() + ")"
+	}
+	return "WARNING: " + warn.Error()
 }
 
 // writeCertFiles writes certificates to disk
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"text/tabwriter"
 
@@ -10,6 +19,16 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// setStdin replaces the stdin of the locations "-" by data
+func setStdin(t *testing.T, data []byte) {
+	stdin = bytes.NewReader(data)
+	stdinOnce = sync.Once{}
+	t.Cleanup(func() {
+		stdin = os.Stdin
+		stdinOnce = sync.Once{}
+	})
+}
+
 func TestColorKeeper_Colourise(t *testing.T) {
 	colourKeeper := make(colourKeeper)
 	assert.NotEmpty(t, colourKeeper.colourise("0"))
@@ -35,20 +54,91 @@ func TestAppendToCertTree(t *testing.T) {
 	assert.Equal(t, 5, len(certs2))
 }
 
+func TestBytesAsHex(t *testing.T) {
+	assert.Equal(t, "00:ab:ff", bytesAsHex([]byte{0, 171, 255}))
+}
+
+func TestDecodeCerts(t *testing.T) {
+	certs, err := decodeCerts("t/cert-and-chain.crt", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(certs))
+
+	certBytes, err := ioutil.ReadFile("t/myserver.crt")
+	assert.NoError(t, err)
+	setStdin(t, certBytes)
+	certs, err = decodeCerts(stdinLocation, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(certs))
+	certs, err = decodeCerts(stdinLocation, "") // read once
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(certs))
+
+	setStdin(t, nil)
+	_, err = decodeCerts(stdinLocation, "")
+	assert.Error(t, err)
+}
+
+func TestDecodeKey(t *testing.T) {
+	keyBytes, err := ioutil.ReadFile("t/myserver.key")
+	assert.NoError(t, err)
+	certBytes, err := ioutil.ReadFile("t/myserver.crt")
+	assert.NoError(t, err)
+	setStdin(t, append(append([]byte{}, certBytes...), keyBytes...))
+	key, err := decodeKey(stdinLocation, "")
+	assert.NoError(t, err)
+	if assert.NotNil(t, key) {
+		assert.Contains(t, key.Type, "PRIVATE KEY")
+	}
+	certs, err := decodeCerts(stdinLocation, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(certs))
+
+	setStdin(t, certBytes)
+	_, err = decodeKey(stdinLocation, "")
+	assert.Error(t, err)
+}
+
+func TestFindIssuer(t *testing.T) {
+	certs, err := certmin.DecodeCertFile("t/cert-and-chain.crt", "")
+	assert.NoError(t, err)
+	issuer := findIssuer(certs[0], certs)
+	if assert.NotNil(t, issuer) {
+		assert.Equal(t, certs[0].Issuer.String(), issuer.Subject.String())
+	}
+	assert.Nil(t, findIssuer(certs[0], certs[:1]))
+}
+
 func TestGetCerts(t *testing.T) {
-	var sb strings.Builder
-	certs, err := getCerts("", &sb)
+	var sb report
+	var params Params
+	certs, err := getCerts("", &sb, params)
 	assert.Error(t, err)
 	assert.Nil(t, certs)
 
-	certs, err = getCerts("t/myserver.crt", &sb)
+	certs, err = getCerts("t/myserver.crt", &sb, params)
 	assert.NoError(t, err)
 	if assert.NotNil(t, certs) {
 		assert.Contains(t, certs[0].Subject.CommonName, "myserver")
 	}
 
+	certs, err = getCerts("t/myserver.pfx", &sb, Params{certPassword: "pass:1234", keyPassword: "pass:foo"})
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, certs) {
+		assert.Contains(t, certs[0].Subject.CommonName, "myserver")
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir("t")))
+	defer server.Close()
+	for _, input := range []string{"get+" + server.URL + "/myserver.crt", server.URL + "/myserver.crt"} {
+		certs, err = getCerts(input, &sb, Params{download: true, proxy: "direct"})
+		assert.NoError(t, err)
+		if assert.Equal(t, 1, len(certs)) {
+			assert.Contains(t, certs[0].Subject.CommonName, "myserver")
+		}
+	}
+
 	if os.Getenv("AUTHOR_TESTING") != "" {
-		certs, err = getCerts("github.com:443", &sb)
+		certs, err = getCerts("github.com:443", &sb, params)
 		assert.NoError(t, err)
 		if assert.NotNil(t, certs) {
 			assert.Contains(t, certs[0].Subject.CommonName, "github")
@@ -56,53 +146,38 @@ func TestGetCerts(t *testing.T) {
 	}
 }
 
-func TestGetLocation(t *testing.T) {
-	loc, remote, err := getLocation("util.go")
+func TestLoadClientCert(t *testing.T) {
+	cert, err := loadClientCert("t/myserver.crt", "t/myserver.key", Params{})
 	assert.NoError(t, err)
-	assert.Equal(t, "util.go", loc)
-	assert.False(t, remote)
-
-	loc, remote, err = getLocation("https://foo.fa/bar?baz")
-	assert.NoError(t, err)
-	assert.Equal(t, "foo.fa:443", loc)
-	assert.True(t, remote)
+	if assert.NotNil(t, cert) {
+		assert.Equal(t, 1, len(cert.Certificate))
+		assert.Equal(t, "myserver", cert.Leaf.Subject.CommonName)
+	}
 
-	loc, remote, err = getLocation("foo/fa")
+	// PKCS12 with the key
+	cert, err = loadClientCert("t/myserver.pfx", "", Params{certPassword: "pass:1234"})
 	assert.NoError(t, err)
-	assert.Equal(t, "foo:443", loc)
-	assert.True(t, remote)
-
-	loc, remote, err = getLocation("foo:abc123")
-	assert.Error(t, err)
+	if assert.NotNil(t, cert) {
+		assert.Equal(t, "myserver", cert.Leaf.Subject.CommonName)
+	}
 }
 
-func TestParseURL(t *testing.T) {
-	remote, err := parseURL("https://foo")
-	assert.Equal(t, "foo:443", remote)
-	assert.Nil(t, err)
-
-	remote, err = parseURL("ldaps://foo")
-	assert.Equal(t, "foo:636", remote)
-	assert.Nil(t, err)
-
-	remote, err = parseURL("foo://foo")
-	assert.Equal(t, "foo:443", remote)
-	assert.Nil(t, err)
+func TestParseLocation(t *testing.T) {
+	loc, err := parseLocation("https://pki.example.com/ca.crt", Params{download: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://pki.example.com/ca.crt", loc.URL)
 
-	remote, err = parseURL("https://foo:123")
-	assert.Equal(t, "foo:123", remote)
-	assert.Nil(t, err)
+	loc, err = parseLocation("https://pki.example.com/ca.crt", Params{})
+	assert.NoError(t, err)
+	assert.True(t, loc.IsRemote())
 
-	remote, err = parseURL("foo://foo:123")
-	assert.Equal(t, "foo:123", remote)
-	assert.Nil(t, err)
+	loc, err = parseLocation("smtp://mail.example.com", Params{download: true})
+	assert.NoError(t, err)
+	assert.True(t, loc.IsRemote())
 
-	_, err = parseURL("foo://foo:1AA23")
-	assert.NotNil(t, err)
-	_, err = parseURL("BLAH:123")
-	assert.NotNil(t, err)
-	_, err = parseURL("BLAH.BOE")
-	assert.NotNil(t, err)
+	loc, err = parseLocation("-", Params{})
+	assert.NoError(t, err)
+	assert.Equal(t, stdinLocation, loc.File)
 }
 
 //func printCert(cert *x509.Certificate, w *tabwriter.Writer, colourKeeper colourKeeper) {
@@ -113,15 +188,127 @@ func TestPrintCert(t *testing.T) {
 	var sb strings.Builder
 	w := tabwriter.NewWriter(&sb, 0, 0, 1, ' ', tabwriter.StripEscape)
 	colourKeeper := make(colourKeeper)
-	printCert(certs[0], w, colourKeeper)
+	printCert(certs[0], w, colourKeeper, nil)
 	w.Flush()
 	assert.Contains(t, sb.String(), "CN=myserver")
+	assert.NotContains(t, sb.String(), "fingerprint")
+	assert.Regexp(t, "Extended key usage:\\s+Server Authentication", sb.String())
+	assert.Contains(t, sb.String(), "2048 bits, exponent 65537")
+
+	sb.Reset()
+	printCert(certs[0], w, colourKeeper, []string{"sha1", "sha256", "spki"})
+	w.Flush()
+	assert.Contains(t, sb.String(), "6c:be:7f:7e:de:b9:c8:16:7c:51:a4:09:78:6c:5d:4b:83:7a:29:54")
+	assert.Contains(t, sb.String(), "2c:50:42:3f:4d:62:41:66:b7:56:1f:e4:92:c3:cd:28:72:74:49:96:27:63:a1:d3:75:e1:d1:43:81:e6:20:60")
+	assert.Contains(t, sb.String(), "Tq+2VNLpVpFvNoz658X3zNE94n6mh1/Rr0HIPyKV9cA=")
+
+	certs, err = certmin.DecodeCertFile("t/san-othername.crt", "")
+	assert.NoError(t, err)
+	sb.Reset()
+	printCert(certs[0], w, colourKeeper, nil)
+	w.Flush()
+	assert.Contains(t, sb.String(), "xn--bcher-kva.example (bücher.example)")
+	assert.Contains(t, sb.String(), "Microsoft UPN: user@corp.example.com")
+	assert.Regexp(t, "Directory names:\\s+CN=Directory Name,O=Example,C=BE", sb.String())
+	assert.Regexp(t, "Registered IDs:\\s+1.2.3.4.5", sb.String())
+}
+
+func TestPrintHandshakeInfo(t *testing.T) {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 1, ' ', tabwriter.StripEscape)
+	info := certmin.HandshakeInfo{
+		Version:             tls.VersionTLS12,
+		CipherSuite:         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		KeyExchangeGroup:    tls.X25519,
+		ClientCertRequested: true,
+		AcceptableCAs:       []string{"CN=Easy-RSA CA"},
+		ClientCertSent:      true,
+	}
+	printHandshakeInfo(&info, w)
+	w.Flush()
+	assert.Regexp(t, "Protocol version:\\s+TLS 1.2", sb.String())
+	assert.Regexp(t, "Cipher suite:\\s+TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", sb.String())
+	assert.Regexp(t, "Key exchange group:\\s+X25519", sb.String())
+	assert.Regexp(t, "SNI:\\s+none", sb.String())
+	assert.Regexp(t, "Client certificate requested:\\s+yes", sb.String())
+	assert.Regexp(t, "Acceptable client CA:\\s+CN=Easy-RSA CA", sb.String())
+	assert.Regexp(t, "Client certificate accepted:\\s+no", sb.String())
+}
+
+func TestPrintIssuerHops(t *testing.T) {
+	var sb strings.Builder
+	hops := []certmin.IssuerHop{
+		{Subject: "CN=leaf", URL: "http://example.com/missing.crt", Err: errors.New("404 Not Found")},
+		{Subject: "CN=leaf", URL: "http://example.com/inter.crt", ContentType: "application/pkix-cert",
+			Certs: make([]*x509.Certificate, 1)},
+		{Subject: "CN=inter", URL: "http://example.com/root.p7c", Cached: true, Certs: make([]*x509.Certificate, 2)},
+		{Subject: "CN=root", URL: "ldap:///CN=Root", Certs: make([]*x509.Certificate, 3)},
+	}
+	printIssuerHops(hops, &sb)
+	assert.Contains(t, sb.String(), "Issuer of CN=leaf: http://example.com/missing.crt\n")
+	assert.Contains(t, sb.String(), "error: 404 Not Found")
+	assert.Contains(t, sb.String(), "application/pkix-cert, 1 certificate(s)")
+	assert.Contains(t, sb.String(), "cached, 2 certificate(s)")
+	assert.Contains(t, sb.String(), "ldap:///CN=Root\n  3 certificate(s)")
+
+	sb.Reset()
+	printIssuerHops(nil, &sb)
+	assert.Empty(t, sb.String())
 }
 
 func TestPromptForKeyPassword(t *testing.T) {
 	t.SkipNow()
 }
 
+func TestReadPassword(t *testing.T) {
+	password, err := readPassword("pass:a:b")
+	assert.NoError(t, err)
+	assert.Equal(t, "a:b", password)
+
+	os.Setenv("CERTMIN_TEST_PASSWORD", "1234")
+	defer os.Unsetenv("CERTMIN_TEST_PASSWORD")
+	password, err = readPassword("env:CERTMIN_TEST_PASSWORD")
+	assert.NoError(t, err)
+	assert.Equal(t, "1234", password)
+	_, err = readPassword("env:CERTMIN_TEST_UNSET")
+	assert.Error(t, err)
+
+	file, err := ioutil.TempFile("", "certmin")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString("5678\r\nfoo\n")
+	file.Close()
+	password, err = readPassword("file:" + file.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "5678", password)
+
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	defer r.Close()
+	w.WriteString("9012")
+	w.Close()
+	fdSource := fmt.Sprintf("fd:%d", r.Fd())
+	password, err = readPassword(fdSource)
+	assert.NoError(t, err)
+	assert.Equal(t, "9012", password)
+	password, err = readPassword(fdSource) // cached
+	assert.NoError(t, err)
+	assert.Equal(t, "9012", password)
+
+	_, err = readPassword("file:t/missing")
+	assert.Error(t, err)
+	_, err = readPassword("secret")
+	assert.Error(t, err)
+}
+
+func TestRetrieveOptions(t *testing.T) {
+	options := retrieveOptions(Params{starttls: "smtp", proxy: "socks5://proxy", timeout: timeOut})
+	assert.Equal(t, timeOut, options.Timeout)
+	assert.Equal(t, "smtp", options.StartTLS)
+	assert.Equal(t, "socks5://proxy", options.Proxy)
+	assert.Nil(t, options.ClientCertificate)
+}
+
 func TestSerialAsHex(t *testing.T) {
 	certs, err := certmin.DecodeCertFile("t/myserver.crt", "")
 	assert.NoError(t, err)
@@ -129,6 +316,26 @@ func TestSerialAsHex(t *testing.T) {
 	assert.Equal(t, "ab:4c:df:e9:a2:13:46:9e:6f:ff:36:1d:90:29:5e:be", serialAsHex(certs[0].SerialNumber))
 }
 
+func TestSplitPEM(t *testing.T) {
+	keyBytes, err := ioutil.ReadFile("t/myserver.key")
+	assert.NoError(t, err)
+	certBytes, err := ioutil.ReadFile("t/cert-and-chain.crt")
+	assert.NoError(t, err)
+	key, other := splitPEM(append(append([]byte{}, keyBytes...), certBytes...))
+	assert.Equal(t, 1, strings.Count(string(key), "-----BEGIN"))
+	assert.Equal(t, 4, strings.Count(string(other), "-----BEGIN"))
+
+	key, other = splitPEM([]byte("foo"))
+	assert.Equal(t, []byte("foo"), key)
+	assert.Equal(t, []byte("foo"), other)
+}
+
+func TestWarningMsg(t *testing.T) {
+	assert.Equal(t, "WARNING: foo", warningMsg(errors.New("foo")))
+	verifyErr := &certmin.VerificationError{Kind: certmin.VerifyErrorHostnameMismatch, Err: errors.New("foo")}
+	assert.Equal(t, "WARNING: hostname mismatch (foo)", warningMsg(verifyErr))
+}
+
 func TestWriteCertFiles(t *testing.T) {
 	certs, err := certmin.DecodeCertFile("t/cert-and-chain.crt", "")
 	assert.NoError(t, err)
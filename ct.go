@@ -0,0 +1,657 @@
+package certmin
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CT entry types as defined in RFC 6962, section 3.4.
+const (
+	CTX509Entry    uint16 = 0
+	CTPrecertEntry uint16 = 1
+)
+
+var (
+	oidExtensionCTPoison  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+	oidExtensionCTSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+)
+
+// CTInclusionProof represents the answer of the get-proof-by-hash call of a
+// Certificate Transparency log.
+type CTInclusionProof struct {
+	LeafIndex uint64
+	AuditPath [][]byte
+}
+
+// CTInclusionResult represents the outcome of a successful inclusion check of a
+// certificate in a Certificate Transparency log.
+type CTInclusionResult struct {
+	LeafHash  []byte
+	LeafIndex uint64
+	STH       *CTSignedTreeHead
+	SCT       *SignedCertificateTimestamp
+}
+
+// CTLog represents a Certificate Transparency log reachable through the RFC 6962
+// HTTP API at URL (e.g. https://ct.example.com/2021). The HTTP requests are made
+// with HTTPClient if set (see Client.NewCTLog) and otherwise with a http.Client
+// using Timeout, with 0 disabling it. PublicKey is the key of the log (see
+// DecodeCTLogKey), needed to verify its signed tree heads.
+type CTLog struct {
+	URL        string
+	Timeout    time.Duration
+	PublicKey  crypto.PublicKey
+	HTTPClient *http.Client
+}
+
+// CTLogEntry represents an entry as returned by the get-entries call of a
+// Certificate Transparency log.
+type CTLogEntry struct {
+	Index     uint64
+	LeafInput []byte
+	ExtraData []byte
+}
+
+// CTSignedTreeHead represents the answer of the get-sth call of a Certificate
+// Transparency log.
+type CTSignedTreeHead struct {
+	TreeSize          uint64
+	Timestamp         uint64
+	SHA256RootHash    []byte
+	TreeHeadSignature []byte
+}
+
+// SignedCertificateTimestamp represents a SCT as embedded in a certificate.
+type SignedCertificateTimestamp struct {
+	Version    uint8
+	LogID      []byte
+	Timestamp  uint64
+	Extensions []byte
+	Signature  []byte
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature (RFC 3279).
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// NewCTLog returns a *CTLog for the log at the given URL, using the time-out
+// duration for the HTTP requests (0 disables it).
+func NewCTLog(logURL string, timeOut time.Duration) *CTLog {
+	return &CTLog{URL: strings.TrimSuffix(logURL, "/"), Timeout: timeOut}
+}
+
+// NewCTLog returns a *CTLog for the log at the given URL that makes its HTTP
+// requests like the Client follows Issuing Certificate URLs: with its dialer
+// and HTTP time-out and through the Proxy field of a *RetrieveOptions (nil for
+// the defaults).
+func (client *Client) NewCTLog(logURL string, options *RetrieveOptions) *CTLog {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+	return &CTLog{
+		URL:        strings.TrimSuffix(logURL, "/"),
+		Timeout:    client.httpTimeout,
+		HTTPClient: client.httpClientFor(options),
+	}
+}
+
+// GetEntries retrieves the entries between start and end (both inclusive) from
+// the log. Logs may return less entries than requested. It returns a []CTLogEntry
+// and an error if encountered.
+func (log *CTLog) GetEntries(start, end uint64) ([]CTLogEntry, error) {
+	if end < start {
+		return nil, errors.New("end of range before start")
+	}
+
+	params := url.Values{}
+	params.Set("start", strconv.FormatUint(start, 10))
+	params.Set("end", strconv.FormatUint(end, 10))
+	var resp struct {
+		Entries []struct {
+			LeafInput []byte `json:"leaf_input"`
+			ExtraData []byte `json:"extra_data"`
+		} `json:"entries"`
+	}
+	if err := log.get("get-entries", params, &resp); err != nil {
+		return nil, err
+	}
+
+	var entries []CTLogEntry
+	for idx, entry := range resp.Entries {
+		entries = append(entries, CTLogEntry{
+			Index:     start + uint64(idx),
+			LeafInput: entry.LeafInput,
+			ExtraData: entry.ExtraData,
+		})
+	}
+
+	return entries, nil
+}
+
+// GetProofByHash retrieves the inclusion proof for a Merkle leaf hash in the tree
+// of the given size. It returns a *CTInclusionProof and an error if encountered.
+func (log *CTLog) GetProofByHash(leafHash []byte, treeSize uint64) (*CTInclusionProof, error) {
+	params := url.Values{}
+	params.Set("hash", base64.StdEncoding.EncodeToString(leafHash))
+	params.Set("tree_size", strconv.FormatUint(treeSize, 10))
+	var resp struct {
+		LeafIndex uint64   `json:"leaf_index"`
+		AuditPath [][]byte `json:"audit_path"`
+	}
+	if err := log.get("get-proof-by-hash", params, &resp); err != nil {
+		return nil, err
+	}
+
+	return &CTInclusionProof{LeafIndex: resp.LeafIndex, AuditPath: resp.AuditPath}, nil
+}
+
+// GetSTH retrieves the latest signed tree head of the log. It returns a
+// *CTSignedTreeHead and an error if encountered.
+func (log *CTLog) GetSTH() (*CTSignedTreeHead, error) {
+	var resp struct {
+		TreeSize          uint64 `json:"tree_size"`
+		Timestamp         uint64 `json:"timestamp"`
+		SHA256RootHash    []byte `json:"sha256_root_hash"`
+		TreeHeadSignature []byte `json:"tree_head_signature"`
+	}
+	if err := log.get("get-sth", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp.SHA256RootHash) != sha256.Size {
+		return nil, errors.New("invalid root hash in signed tree head")
+	}
+
+	return &CTSignedTreeHead{
+		TreeSize:          resp.TreeSize,
+		Timestamp:         resp.Timestamp,
+		SHA256RootHash:    resp.SHA256RootHash,
+		TreeHeadSignature: resp.TreeHeadSignature,
+	}, nil
+}
+
+// SearchEntries looks for a certificate between the entries start and end (both
+// inclusive) of the log, matching both X509 and precertificate entries. It returns
+// the matching *CTLogEntry, or nil if not found, and an error if encountered.
+func (log *CTLog) SearchEntries(cert *x509.Certificate, start, end uint64) (*CTLogEntry, error) {
+	tbs, err := ctPrecertTBS(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	for start <= end {
+		entries, err := log.GetEntries(start, end)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		for idx := range entries {
+			entryType, signed, err := ctSignedEntry(entries[idx].LeafInput)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case entryType == CTX509Entry && bytes.Equal(signed, cert.Raw):
+				return &entries[idx], nil
+			case entryType == CTPrecertEntry && len(signed) > sha256.Size && bytes.Equal(signed[sha256.Size:], tbs):
+				return &entries[idx], nil
+			}
+		}
+		start = entries[len(entries)-1].Index + 1
+	}
+
+	return nil, nil
+}
+
+// VerifyInclusion verifies that a certificate with embedded SCTs is included in the
+// log. The issuer certificate is needed to compute the precertificate leaf. Only the
+// SCTs issued by the log (matching the ID of its PublicKey) are checked, against the
+// latest signed tree head after verifying its signature. It returns a
+// *CTInclusionResult for the first SCT that could be verified and an error if none
+// could be verified.
+func (log *CTLog) VerifyInclusion(cert, issuer *x509.Certificate) (*CTInclusionResult, error) {
+	if log.PublicKey == nil {
+		return nil, errors.New("the public key of the log is needed to verify its signed tree head")
+	}
+	logID, err := CTLogID(log.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	scts, err := ParseSCTList(cert)
+	if err != nil {
+		return nil, err
+	}
+	if len(scts) == 0 {
+		return nil, errors.New("no embedded SCTs found in certificate")
+	}
+	var logSCTs []*SignedCertificateTimestamp
+	for _, sct := range scts {
+		if bytes.Equal(sct.LogID, logID) {
+			logSCTs = append(logSCTs, sct)
+		}
+	}
+	if len(logSCTs) == 0 {
+		return nil, fmt.Errorf("no embedded SCTs of the log (log ID %s) found in certificate",
+			base64.StdEncoding.EncodeToString(logID))
+	}
+
+	sth, err := log.GetSTH()
+	if err != nil {
+		return nil, err
+	}
+	if err := sth.VerifySignature(log.PublicKey); err != nil {
+		return nil, err
+	}
+
+	var errStrs []string
+	for _, sct := range logSCTs {
+		leaf, err := CTMerkleTreeLeaf(cert, issuer, sct.Timestamp, sct.Extensions, true)
+		if err != nil {
+			return nil, err
+		}
+		leafHash := CTLeafHash(leaf)
+
+		proof, err := log.GetProofByHash(leafHash, sth.TreeSize)
+		if err != nil {
+			errStrs = append(errStrs, err.Error())
+			continue
+		}
+
+		err = VerifyCTInclusionProof(leafHash, proof.LeafIndex, sth.TreeSize, proof.AuditPath, sth.SHA256RootHash)
+		if err != nil {
+			errStrs = append(errStrs, err.Error())
+			continue
+		}
+
+		return &CTInclusionResult{LeafHash: leafHash, LeafIndex: proof.LeafIndex, STH: sth, SCT: sct}, nil
+	}
+
+	return nil, errors.New(strings.Join(errStrs, "   >>   "))
+}
+
+// VerifySignature verifies the tree head signature of the signed tree head with
+// the public key of the log. It returns an error if the verification fails.
+func (sth *CTSignedTreeHead) VerifySignature(logKey crypto.PublicKey) error {
+	sig := sth.TreeHeadSignature
+	if len(sig) < 4 || int(binary.BigEndian.Uint16(sig[2:4])) != len(sig)-4 {
+		return errors.New("invalid tree head signature")
+	}
+	if sig[0] != 4 { // sha256
+		return fmt.Errorf("unsupported hash algorithm in tree head signature (%d)", sig[0])
+	}
+
+	var signed []byte
+	signed = append(signed, 0, 1) // v1, tree_hash
+	signed = appendUint64(signed, sth.Timestamp)
+	signed = appendUint64(signed, sth.TreeSize)
+	signed = append(signed, sth.SHA256RootHash...)
+	digest := sha256.Sum256(signed)
+
+	switch key := logKey.(type) {
+	case *ecdsa.PublicKey:
+		var ecdsaSig ecdsaSignature
+		if rest, err := asn1.Unmarshal(sig[4:], &ecdsaSig); err != nil || len(rest) > 0 {
+			return errors.New("invalid tree head signature")
+		}
+		if !ecdsa.Verify(key, digest[:], ecdsaSig.R, ecdsaSig.S) {
+			return errors.New("tree head signature does not match")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig[4:]); err != nil {
+			return errors.New("tree head signature does not match")
+		}
+	default:
+		return errors.New("unsupported public key type for log")
+	}
+
+	return nil
+}
+
+// CTLeafHash returns the Merkle leaf hash of a MerkleTreeLeaf structure (e.g. the
+// leaf_input of a log entry or the result of CTMerkleTreeLeaf).
+func CTLeafHash(leaf []byte) []byte {
+	hash := sha256.Sum256(append([]byte{0}, leaf...))
+	return hash[:]
+}
+
+// CTLogID returns the ID of a Certificate Transparency log, the SHA-256 hash of its
+// public key as embedded in its SCTs, and an error if encountered.
+func CTLogID(logKey crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(logKey)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(der)
+	return hash[:], nil
+}
+
+// CTMerkleTreeLeaf builds the RFC 6962 MerkleTreeLeaf structure for a certificate.
+// As parameters it takes the *x509.Certificate, the *x509.Certificate of its issuer
+// (only needed for precertificates), the timestamp and extensions of the SCT and a
+// boolean stating if the leaf is a precertificate entry. For certificates with
+// embedded SCTs the precertificate leaf is the one that was logged. It returns
+// the leaf as a []byte and an error if encountered.
+func CTMerkleTreeLeaf(
+	cert, issuer *x509.Certificate, timestamp uint64, extensions []byte, precert bool) ([]byte, error) {
+	leaf := []byte{0, 0} // v1, timestamped_entry
+	leaf = appendUint64(leaf, timestamp)
+	if precert {
+		if issuer == nil {
+			return nil, errors.New("the issuer is needed for a precertificate entry")
+		}
+		tbs, err := ctPrecertTBS(cert)
+		if err != nil {
+			return nil, err
+		}
+		issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+		leaf = appendUint16(leaf, CTPrecertEntry)
+		leaf = append(leaf, issuerKeyHash[:]...)
+		leaf = appendUint24Bytes(leaf, tbs)
+	} else {
+		leaf = appendUint16(leaf, CTX509Entry)
+		leaf = appendUint24Bytes(leaf, cert.Raw)
+	}
+	leaf = appendUint16(leaf, uint16(len(extensions)))
+	leaf = append(leaf, extensions...)
+
+	return leaf, nil
+}
+
+// DecodeCTLogKey reads the public key of a Certificate Transparency log as PEM, DER
+// or base64 encoded DER (as published in the log lists) and returns it as a
+// crypto.PublicKey and an error if encountered.
+func DecodeCTLogKey(keyBytes []byte) (crypto.PublicKey, error) {
+	der := keyBytes
+	if block, _ := pem.Decode(keyBytes); block != nil {
+		der = block.Bytes
+	} else if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(keyBytes))); err == nil {
+		der = decoded
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, errors.New("unsupported public key type for log")
+	}
+}
+
+// ParseSCTList returns the SCTs embedded in a certificate as a
+// []*SignedCertificateTimestamp and an error if encountered.
+func ParseSCTList(cert *x509.Certificate) ([]*SignedCertificateTimestamp, error) {
+	var extValue []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidExtensionCTSCTList) {
+			extValue = ext.Value
+		}
+	}
+	if extValue == nil {
+		return nil, nil
+	}
+
+	var list []byte
+	if _, err := asn1.Unmarshal(extValue, &list); err != nil {
+		return nil, err
+	}
+
+	data, list, err := readUint16Bytes(list)
+	if err != nil || len(list) != 0 {
+		return nil, errors.New("invalid SCT list")
+	}
+
+	var scts []*SignedCertificateTimestamp
+	for len(data) > 0 {
+		var raw []byte
+		raw, data, err = readUint16Bytes(data)
+		if err != nil {
+			return nil, errors.New("invalid SCT list")
+		}
+		if len(raw) < 1+32+8 {
+			return nil, errors.New("invalid SCT")
+		}
+
+		sct := SignedCertificateTimestamp{
+			Version:   raw[0],
+			LogID:     raw[1:33],
+			Timestamp: binary.BigEndian.Uint64(raw[33:41]),
+		}
+		sct.Extensions, raw, err = readUint16Bytes(raw[41:])
+		if err != nil {
+			return nil, errors.New("invalid SCT extensions")
+		}
+		sct.Signature = raw
+		scts = append(scts, &sct)
+	}
+
+	return scts, nil
+}
+
+// VerifyCTInclusionProof verifies the audit path of a leaf hash at the given index
+// against the root hash of a tree of the given size, as described in RFC 9162,
+// section 2.1.3.2. It returns an error if the proof is invalid.
+func VerifyCTInclusionProof(
+	leafHash []byte, leafIndex, treeSize uint64, auditPath [][]byte, rootHash []byte) error {
+	if leafIndex >= treeSize {
+		return fmt.Errorf("leaf index %d out of range for tree size %d", leafIndex, treeSize)
+	}
+
+	fn, sn := leafIndex, treeSize-1
+	hash := leafHash
+	for _, node := range auditPath {
+		if sn == 0 {
+			return errors.New("audit path longer than expected")
+		}
+		if fn&1 == 1 || fn == sn {
+			hash = ctNodeHash(node, hash)
+			if fn&1 == 0 {
+				for fn&1 == 0 && fn != 0 {
+					fn >>= 1
+					sn >>= 1
+				}
+			}
+		} else {
+			hash = ctNodeHash(hash, node)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New("audit path shorter than expected")
+	}
+	if !bytes.Equal(hash, rootHash) {
+		return errors.New("calculated root hash does not match the signed tree head")
+	}
+
+	return nil
+}
+
+// get does a GET request to an RFC 6962 endpoint and decodes the JSON answer
+func (log *CTLog) get(endpoint string, params url.Values, result interface{}) error {
+	reqURL := log.URL + "/ct/v1/" + endpoint
+	if params != nil {
+		reqURL += "?" + params.Encode()
+	}
+
+	client := log.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: log.Timeout}
+	}
+	resp, err := client.Get(reqURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s (%s)", endpoint, resp.Status, strings.TrimSpace(string(bodyBytes)))
+	}
+
+	if err := json.Unmarshal(bodyBytes, result); err != nil {
+		return fmt.Errorf("%s: %s", endpoint, err)
+	}
+
+	return nil
+}
+
+// ctNodeHash returns the hash of an interior node of the Merkle tree
+func ctNodeHash(left, right []byte) []byte {
+	data := append([]byte{1}, left...)
+	data = append(data, right...)
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// ctPrecertTBS returns the TBSCertificate of a certificate without the
+// poison and SCT list extensions, as logged for precertificates.
+func ctPrecertTBS(cert *x509.Certificate) ([]byte, error) {
+	var tbs asn1.RawValue
+	if _, err := asn1.Unmarshal(cert.RawTBSCertificate, &tbs); err != nil {
+		return nil, err
+	}
+
+	var fields []byte
+	rest := tbs.Bytes
+	for len(rest) > 0 {
+		var field asn1.RawValue
+		var err error
+		rest, err = asn1.Unmarshal(rest, &field)
+		if err != nil {
+			return nil, err
+		}
+
+		if field.Class != asn1.ClassContextSpecific || field.Tag != 3 {
+			fields = append(fields, field.FullBytes...)
+			continue
+		}
+
+		var exts []asn1.RawValue
+		if _, err := asn1.Unmarshal(field.Bytes, &exts); err != nil {
+			return nil, err
+		}
+		var kept []asn1.RawValue
+		for _, ext := range exts {
+			var oid asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(ext.Bytes, &oid); err != nil {
+				return nil, err
+			}
+			if oid.Equal(oidExtensionCTPoison) || oid.Equal(oidExtensionCTSCTList) {
+				continue
+			}
+			kept = append(kept, ext)
+		}
+		if len(kept) == 0 {
+			continue
+		}
+
+		extBytes, err := asn1.Marshal(kept)
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := asn1.Marshal(asn1.RawValue{
+			Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: extBytes})
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, wrapped...)
+	}
+
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: fields})
+}
+
+// ctSignedEntry returns the entry type and the signed entry of a MerkleTreeLeaf
+func ctSignedEntry(leaf []byte) (uint16, []byte, error) {
+	if len(leaf) < 2+8+2 || leaf[0] != 0 || leaf[1] != 0 {
+		return 0, nil, errors.New("unsupported Merkle tree leaf")
+	}
+
+	entryType := binary.BigEndian.Uint16(leaf[10:12])
+	data := leaf[12:]
+	if entryType == CTPrecertEntry {
+		if len(data) < sha256.Size {
+			return 0, nil, errors.New("invalid precertificate entry")
+		}
+		tbs, _, err := readUint24Bytes(data[sha256.Size:])
+		if err != nil {
+			return 0, nil, err
+		}
+		return entryType, append(data[:sha256.Size:sha256.Size], tbs...), nil
+	}
+
+	cert, _, err := readUint24Bytes(data)
+	return entryType, cert, err
+}
+
+// appendUint16 appends a big-endian uint16
+func appendUint16(data []byte, value uint16) []byte {
+	return append(data, byte(value>>8), byte(value))
+}
+
+// appendUint24Bytes appends a byte slice prefixed by its 24-bit length
+func appendUint24Bytes(data, value []byte) []byte {
+	length := len(value)
+	data = append(data, byte(length>>16), byte(length>>8), byte(length))
+	return append(data, value...)
+}
+
+// appendUint64 appends a big-endian uint64
+func appendUint64(data []byte, value uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], value)
+	return append(data, buf[:]...)
+}
+
+// readUint16Bytes reads a byte slice prefixed by its 16-bit length
+func readUint16Bytes(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errors.New("truncated data")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return nil, nil, errors.New("truncated data")
+	}
+	return data[2 : 2+length], data[2+length:], nil
+}
+
+// readUint24Bytes reads a byte slice prefixed by its 24-bit length
+func readUint24Bytes(data []byte) ([]byte, []byte, error) {
+	if len(data) < 3 {
+		return nil, nil, errors.New("truncated data")
+	}
+	length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	if len(data) < 3+length {
+		return nil, nil, errors.New("truncated data")
+	}
+	return data[3 : 3+length], data[3+length:], nil
+}
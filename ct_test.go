@@ -0,0 +1,420 @@
+package certmin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nxadm/certmin/internal/testcert"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCTLog is a minimal in-memory RFC 6962 log
+type testCTLog struct {
+	leaves [][]byte
+	key    *ecdsa.PrivateKey
+}
+
+func (log *testCTLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp interface{}
+	switch r.URL.Path {
+	case "/ct/v1/get-sth":
+		root := testMTH(log.hashes())
+		sth := CTSignedTreeHead{TreeSize: uint64(len(log.leaves)), Timestamp: 1, SHA256RootHash: root}
+		var signed []byte
+		signed = append(signed, 0, 1)
+		signed = appendUint64(signed, sth.Timestamp)
+		signed = appendUint64(signed, sth.TreeSize)
+		signed = append(signed, root...)
+		digest := sha256.Sum256(signed)
+		r, ss, _ := ecdsa.Sign(rand.Reader, log.key, digest[:])
+		sig, _ := asn1.Marshal(ecdsaSignature{r, ss})
+		sigStruct := append([]byte{4, 3}, appendUint16(nil, uint16(len(sig)))...)
+		resp = map[string]interface{}{
+			"tree_size":           sth.TreeSize,
+			"timestamp":           sth.Timestamp,
+			"sha256_root_hash":    root,
+			"tree_head_signature": append(sigStruct, sig...),
+		}
+	case "/ct/v1/get-proof-by-hash":
+		hash, _ := base64.StdEncoding.DecodeString(r.URL.Query().Get("hash"))
+		size, _ := strconv.Atoi(r.URL.Query().Get("tree_size"))
+		hashes := log.hashes()[:size]
+		idx := -1
+		for i, h := range hashes {
+			if string(h) == string(hash) {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		resp = map[string]interface{}{"leaf_index": idx, "audit_path": testPath(idx, hashes)}
+	case "/ct/v1/get-entries":
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		end, _ := strconv.Atoi(r.URL.Query().Get("end"))
+		if end >= len(log.leaves) {
+			end = len(log.leaves) - 1
+		}
+		if end > start+1 { // return partial pages
+			end = start + 1
+		}
+		var entries []map[string][]byte
+		for idx := start; idx <= end; idx++ {
+			entries = append(entries, map[string][]byte{"leaf_input": log.leaves[idx], "extra_data": {}})
+		}
+		resp = map[string]interface{}{"entries": entries}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (log *testCTLog) hashes() [][]byte {
+	var hashes [][]byte
+	for _, leaf := range log.leaves {
+		hashes = append(hashes, CTLeafHash(leaf))
+	}
+	return hashes
+}
+
+// testMTH computes the Merkle tree hash (RFC 6962, section 2.1)
+func testMTH(hashes [][]byte) []byte {
+	if len(hashes) == 1 {
+		return hashes[0]
+	}
+	k := testSplit(len(hashes))
+	return ctNodeHash(testMTH(hashes[:k]), testMTH(hashes[k:]))
+}
+
+// testPath computes the Merkle audit path (RFC 6962, section 2.1.1)
+func testPath(m int, hashes [][]byte) [][]byte {
+	if len(hashes) <= 1 {
+		return [][]byte{}
+	}
+	k := testSplit(len(hashes))
+	if m < k {
+		return append(testPath(m, hashes[:k]), testMTH(hashes[k:]))
+	}
+	return append(testPath(m-k, hashes[k:]), testMTH(hashes[:k]))
+}
+
+func testSplit(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// testSCTCert creates a certificate signed by the issuer (self-signed if nil) with
+// an embedded SCT (with timestamp 1000 + its index) for each of the log IDs
+func testSCTCert(t *testing.T, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey,
+	logIDs ...[]byte) *x509.Certificate {
+	var list []byte
+	for idx, logID := range logIDs {
+		sct := append([]byte{0}, logID...)
+		sct = appendUint64(sct, uint64(1000+idx))
+		sct = appendUint16(sct, 0)                // extensions
+		sct = append(sct, 4, 3, 0, 2, 0xca, 0xfe) // signature
+		list = append(appendUint16(list, uint16(len(sct))), sct...)
+	}
+	extValue, err := asn1.Marshal(append(appendUint16(nil, uint16(len(list))), list...))
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: "sct"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: oidExtensionCTSCTList, Value: extValue}},
+	}
+	cert, _ := testcert.Sign(t, template, issuer, issuerKey)
+	return cert
+}
+
+// newTestCTLog returns a log with 6 other certificates and, as last entry, a
+// certificate with SCTs of another log and of the log, followed by its issuer
+func newTestCTLog(t *testing.T) (*testCTLog, *x509.Certificate, *x509.Certificate) {
+	other, err := DecodeCertFile("t/myserver.crt", "")
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	logID, err := CTLogID(&key.PublicKey)
+	assert.NoError(t, err)
+	issuer, issuerKey := testcert.Issued(t, "issuer", true, nil, nil)
+	cert := testSCTCert(t, issuer, issuerKey, make([]byte, 32), logID)
+	scts, err := ParseSCTList(cert)
+	assert.NoError(t, err)
+
+	log := testCTLog{key: key}
+	for idx := 0; idx < 6; idx++ {
+		leaf, err := CTMerkleTreeLeaf(other[0], nil, uint64(idx), nil, false)
+		assert.NoError(t, err)
+		log.leaves = append(log.leaves, leaf)
+	}
+	leaf, err := CTMerkleTreeLeaf(cert, issuer, scts[1].Timestamp, scts[1].Extensions, true)
+	assert.NoError(t, err)
+	log.leaves = append(log.leaves, leaf)
+
+	return &log, cert, issuer
+}
+
+func TestCTLog_GetEntries(t *testing.T) {
+	testLog, _, _ := newTestCTLog(t)
+	server := httptest.NewServer(testLog)
+	defer server.Close()
+
+	entries, err := NewCTLog(server.URL, 0).GetEntries(2, 5)
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(entries)) {
+		assert.Equal(t, uint64(3), entries[1].Index)
+		assert.Equal(t, testLog.leaves[3], entries[1].LeafInput)
+	}
+
+	_, err = NewCTLog(server.URL, 0).GetEntries(5, 2)
+	assert.Error(t, err)
+}
+
+func TestCTLog_GetProofByHash(t *testing.T) {
+	testLog, _, _ := newTestCTLog(t)
+	server := httptest.NewServer(testLog)
+	defer server.Close()
+
+	proof, err := NewCTLog(server.URL, 0).GetProofByHash(CTLeafHash(testLog.leaves[6]), 7)
+	assert.NoError(t, err)
+	if assert.NotNil(t, proof) {
+		assert.Equal(t, uint64(6), proof.LeafIndex)
+		assert.Equal(t, 2, len(proof.AuditPath))
+	}
+
+	_, err = NewCTLog(server.URL, 0).GetProofByHash([]byte("foo"), 7)
+	assert.Error(t, err)
+}
+
+func TestCTLog_GetSTH(t *testing.T) {
+	testLog, _, _ := newTestCTLog(t)
+	server := httptest.NewServer(testLog)
+	defer server.Close()
+
+	sth, err := NewCTLog(server.URL+"/", 0).GetSTH()
+	assert.NoError(t, err)
+	if assert.NotNil(t, sth) {
+		assert.Equal(t, uint64(7), sth.TreeSize)
+		assert.Equal(t, testMTH(testLog.hashes()), sth.SHA256RootHash)
+	}
+
+	_, err = NewCTLog(server.URL+"/foo", 0).GetSTH()
+	assert.Error(t, err)
+}
+
+func TestCTLog_SearchEntries(t *testing.T) {
+	testLog, cert, _ := newTestCTLog(t)
+	server := httptest.NewServer(testLog)
+	defer server.Close()
+
+	entry, err := NewCTLog(server.URL, 0).SearchEntries(cert, 0, 6)
+	assert.NoError(t, err)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, uint64(6), entry.Index)
+	}
+
+	entry, err = NewCTLog(server.URL, 0).SearchEntries(cert, 0, 5)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+}
+
+func TestCTLog_VerifyInclusion(t *testing.T) {
+	testLog, cert, issuer := newTestCTLog(t)
+	server := httptest.NewServer(testLog)
+	defer server.Close()
+
+	log := NewCTLog(server.URL, 0)
+	log.PublicKey = &testLog.key.PublicKey
+	result, err := log.VerifyInclusion(cert, issuer)
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		assert.Equal(t, uint64(6), result.LeafIndex)
+		assert.Equal(t, CTLeafHash(testLog.leaves[6]), result.LeafHash)
+		assert.Equal(t, uint64(1001), result.SCT.Timestamp)
+	}
+
+	// No public key
+	_, err = NewCTLog(server.URL, 0).VerifyInclusion(cert, issuer)
+	assert.Error(t, err)
+
+	// No SCTs or no SCTs of the log
+	other, err := DecodeCertFile("t/myserver.crt", "")
+	assert.NoError(t, err)
+	_, err = log.VerifyInclusion(other[0], issuer)
+	assert.Error(t, err)
+	otherLogKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	wrongLog := NewCTLog(server.URL, 0)
+	wrongLog.PublicKey = &otherLogKey.PublicKey
+	_, err = wrongLog.VerifyInclusion(cert, issuer)
+	assert.Error(t, err)
+
+	// Signed tree head not signed by the log
+	logID, err := CTLogID(&otherLogKey.PublicKey)
+	assert.NoError(t, err)
+	selfSigned := testSCTCert(t, nil, nil, logID)
+	_, err = wrongLog.VerifyInclusion(selfSigned, selfSigned)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tree head signature")
+	}
+
+	testLog.leaves = testLog.leaves[:6]
+	_, err = log.VerifyInclusion(cert, issuer)
+	assert.Error(t, err)
+}
+
+func TestCTSignedTreeHead_VerifySignature(t *testing.T) {
+	testLog, _, _ := newTestCTLog(t)
+	server := httptest.NewServer(testLog)
+	defer server.Close()
+
+	sth, err := NewCTLog(server.URL, 0).GetSTH()
+	assert.NoError(t, err)
+	assert.NoError(t, sth.VerifySignature(&testLog.key.PublicKey))
+
+	sth.TreeSize++
+	assert.Error(t, sth.VerifySignature(&testLog.key.PublicKey))
+}
+
+func TestClient_NewCTLog(t *testing.T) {
+	testLog, _, _ := newTestCTLog(t)
+	server := httptest.NewServer(testLog)
+	defer server.Close()
+
+	var dials int
+	client := NewClient(WithHTTPTimeout(5*time.Second), WithDialContext(
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials++
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}))
+	log := client.NewCTLog(server.URL+"/", nil)
+	assert.Equal(t, server.URL, log.URL)
+	assert.Equal(t, 5*time.Second, log.Timeout)
+	sth, err := log.GetSTH()
+	assert.NoError(t, err)
+	if assert.NotNil(t, sth) {
+		assert.Equal(t, uint64(7), sth.TreeSize)
+	}
+	assert.Equal(t, 1, dials)
+}
+
+func TestCTLeafHash(t *testing.T) {
+	assert.Equal(t, 32, len(CTLeafHash([]byte("foo"))))
+	assert.NotEqual(t, CTLeafHash([]byte("foo")), CTLeafHash([]byte("bar")))
+}
+
+func TestCTLogID(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	logID, err := CTLogID(&key.PublicKey)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	hash := sha256.Sum256(der)
+	assert.Equal(t, hash[:], logID)
+
+	_, err = CTLogID("foo")
+	assert.Error(t, err)
+}
+
+func TestCTMerkleTreeLeaf(t *testing.T) {
+	certs, err := DecodeCertFile("t/myserver.crt", "")
+	assert.NoError(t, err)
+	leaf, err := CTMerkleTreeLeaf(certs[0], nil, 1, nil, false)
+	assert.NoError(t, err)
+	entryType, signed, err := ctSignedEntry(leaf)
+	assert.NoError(t, err)
+	assert.Equal(t, CTX509Entry, entryType)
+	assert.Equal(t, certs[0].Raw, signed)
+
+	_, err = CTMerkleTreeLeaf(certs[0], nil, 1, nil, true)
+	assert.Error(t, err)
+}
+
+func TestDecodeCTLogKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	for _, keyBytes := range [][]byte{
+		der,
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		[]byte(base64.StdEncoding.EncodeToString(der) + "\n"),
+	} {
+		logKey, err := DecodeCTLogKey(keyBytes)
+		assert.NoError(t, err)
+		assert.Equal(t, &key.PublicKey, logKey)
+	}
+
+	_, err = DecodeCTLogKey([]byte("foo"))
+	assert.Error(t, err)
+}
+
+func TestParseSCTList(t *testing.T) {
+	certs, err := DecodeCertFile("t/kuleuven-be.pem", "")
+	assert.NoError(t, err)
+	scts, err := ParseSCTList(certs[0])
+	assert.NoError(t, err)
+	if assert.True(t, len(scts) >= 2) {
+		assert.Equal(t, uint8(0), scts[0].Version)
+		assert.Equal(t, 32, len(scts[0].LogID))
+	}
+
+	certs, err = DecodeCertFile("t/myserver.crt", "")
+	assert.NoError(t, err)
+	scts, err = ParseSCTList(certs[0])
+	assert.NoError(t, err)
+	assert.Nil(t, scts)
+}
+
+func TestVerifyCTInclusionProof(t *testing.T) {
+	var hashes [][]byte
+	for _, leaf := range []string{"a", "b", "c", "d", "e"} {
+		hashes = append(hashes, CTLeafHash([]byte(leaf)))
+	}
+	root := testMTH(hashes)
+	for idx := range hashes {
+		assert.NoError(t, VerifyCTInclusionProof(hashes[idx], uint64(idx), 5, testPath(idx, hashes), root))
+	}
+	assert.Error(t, VerifyCTInclusionProof(hashes[0], 1, 5, testPath(0, hashes), root))
+	assert.Error(t, VerifyCTInclusionProof(hashes[0], 5, 5, testPath(0, hashes), root))
+	assert.Error(t, VerifyCTInclusionProof(hashes[0], 0, 5, testPath(0, hashes)[1:], root))
+}
+
+func TestCTPrecertTBS(t *testing.T) {
+	certs, err := DecodeCertFile("t/kuleuven-be.pem", "")
+	assert.NoError(t, err)
+	tbs, err := ctPrecertTBS(certs[0])
+	assert.NoError(t, err)
+	assert.True(t, len(tbs) < len(certs[0].RawTBSCertificate))
+
+	certs, err = DecodeCertFile("t/myserver.crt", "")
+	assert.NoError(t, err)
+	tbs, err = ctPrecertTBS(certs[0])
+	assert.NoError(t, err)
+	assert.Equal(t, certs[0].RawTBSCertificate, tbs)
+}
@@ -0,0 +1,367 @@
+package certmin
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"strconv"
+)
+
+var (
+	oidPolicyQualifierCPS        = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 1}
+	oidPolicyQualifierUserNotice = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 2}
+	oidExtensionCertPolicies     = asn1.ObjectIdentifier{2, 5, 29, 32}
+	oidExtensionTLSFeature       = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+)
+
+// extensionNames maps the OIDs of well-known extensions to their names.
+var extensionNames = map[string]string{
+	"1.3.6.1.4.1.311.20.2":    "Microsoft Certificate Template Name",
+	"1.3.6.1.4.1.311.21.1":    "Microsoft CA Version",
+	"1.3.6.1.4.1.311.21.2":    "Microsoft Previous CA Certificate Hash",
+	"1.3.6.1.4.1.311.21.7":    "Microsoft Certificate Template",
+	"1.3.6.1.4.1.311.21.10":   "Microsoft Application Policies",
+	"1.3.6.1.4.1.11129.2.4.2": "CT Precertificate SCTs",
+	"1.3.6.1.4.1.11129.2.4.3": "CT Precertificate Poison",
+	"1.3.6.1.5.5.7.1.1":       "Authority Information Access",
+	"1.3.6.1.5.5.7.1.3":       "Qualified Certificate Statements",
+	"1.3.6.1.5.5.7.1.11":      "Subject Information Access",
+	"1.3.6.1.5.5.7.1.24":      "TLS Feature",
+	"1.3.6.1.5.5.7.48.1.5":    "OCSP No Check",
+	"2.5.29.9":                "Subject Directory Attributes",
+	"2.5.29.14":               "Subject Key Identifier",
+	"2.5.29.15":               "Key Usage",
+	"2.5.29.16":               "Private Key Usage Period",
+	"2.5.29.17":               "Subject Alternative Name",
+	"2.5.29.18":               "Issuer Alternative Name",
+	"2.5.29.19":               "Basic Constraints",
+	"2.5.29.30":               "Name Constraints",
+	"2.5.29.31":               "CRL Distribution Points",
+	"2.5.29.32":               "Certificate Policies",
+	"2.5.29.33":               "Policy Mappings",
+	"2.5.29.35":               "Authority Key Identifier",
+	"2.5.29.36":               "Policy Constraints",
+	"2.5.29.37":               "Extended Key Usage",
+	"2.5.29.46":               "Freshest CRL",
+	"2.5.29.54":               "Inhibit anyPolicy",
+	"2.16.840.1.113730.1.1":   "Netscape Certificate Type",
+	"2.16.840.1.113730.1.13":  "Netscape Comment",
+}
+
+// extKeyUsageNames maps the extended key usages known by crypto/x509 to their names.
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:                            "Any",
+	x509.ExtKeyUsageServerAuth:                     "Server Authentication",
+	x509.ExtKeyUsageClientAuth:                     "Client Authentication",
+	x509.ExtKeyUsageCodeSigning:                    "Code Signing",
+	x509.ExtKeyUsageEmailProtection:                "Email Protection",
+	x509.ExtKeyUsageIPSECEndSystem:                 "IPSEC End System",
+	x509.ExtKeyUsageIPSECTunnel:                    "IPSEC Tunnel",
+	x509.ExtKeyUsageIPSECUser:                      "IPSEC User",
+	x509.ExtKeyUsageTimeStamping:                   "Time Stamping",
+	x509.ExtKeyUsageOCSPSigning:                    "OCSP Signing",
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     "Microsoft Server Gated Crypto",
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      "Netscape Server Gated Crypto",
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "Microsoft Commercial Code Signing",
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     "Microsoft Kernel Code Signing",
+}
+
+// unknownExtKeyUsageNames maps the OIDs of extended key usages not known
+// by crypto/x509 to their names.
+var unknownExtKeyUsageNames = map[string]string{
+	"1.3.6.1.4.1.311.10.3.4":  "Microsoft Encrypting File System",
+	"1.3.6.1.4.1.311.10.3.12": "Microsoft Document Signing",
+	"1.3.6.1.4.1.311.20.2.2":  "Microsoft Smartcard Logon",
+	"1.3.6.1.5.2.3.4":         "Kerberos Client Authentication",
+	"1.3.6.1.5.2.3.5":         "Kerberos KDC",
+	"1.3.6.1.5.5.7.3.17":      "IPSEC IKE",
+	"1.3.6.1.5.5.7.3.30":      "Certificate Transparency",
+	"2.23.133.8.1":            "TCG EK Certificate",
+}
+
+// keyUsageNames lists the names of the key usage bits, in order.
+var keyUsageNames = []string{
+	"Digital Signature",
+	"Content Commitment",
+	"Key Encipherment",
+	"Data Encipherment",
+	"Key Agreement",
+	"Certificate Sign",
+	"CRL Sign",
+	"Encipher Only",
+	"Decipher Only",
+}
+
+// policyNames maps the OIDs of well-known certificate policies to their names.
+var policyNames = map[string]string{
+	"2.5.29.32.0":    "anyPolicy",
+	"2.23.140.1.1":   "CA/B Forum Extended Validation",
+	"2.23.140.1.2.1": "CA/B Forum Domain Validated",
+	"2.23.140.1.2.2": "CA/B Forum Organization Validated",
+	"2.23.140.1.2.3": "CA/B Forum Individual Validated",
+	"2.23.140.1.3":   "CA/B Forum Extended Validation Code Signing",
+	"2.23.140.1.4.1": "CA/B Forum Code Signing",
+	"2.23.140.1.31":  "CA/B Forum Onion Extended Validation",
+}
+
+// factoringStrengths maps RSA and DSA key sizes to their estimated security
+// level in bits (NIST SP 800-57 Part 1, table 2), from strong to weak.
+var factoringStrengths = []struct{ bits, strength int }{
+	{15360, 256},
+	{7680, 192},
+	{3072, 128},
+	{2048, 112},
+	{1024, 80},
+	{512, 56},
+}
+
+// curveStrengths maps the ECDSA curves to their security level in bits (NIST
+// SP 800-57 Part 1, table 2).
+var curveStrengths = map[string]int{
+	"P-224": 112,
+	"P-256": 128,
+	"P-384": 192,
+	"P-521": 256,
+}
+
+// tlsFeatureNames maps TLS extension numbers used in the TLS Feature extension
+// (RFC 7633) to their names.
+var tlsFeatureNames = map[int]string{
+	5:  "status_request (OCSP Must-Staple)",
+	17: "status_request_v2",
+}
+
+// CertDescription represents the extensions of a certificate in a human-readable
+// form. Names of unknown key usages and policies are given as OIDs.
+type CertDescription struct {
+	KeyUsage                     []string
+	ExtKeyUsage                  []string
+	BasicConstraintsValid        bool
+	IsCA                         bool
+	MaxPathLen                   int // -1 if no limit was set
+	SubjectKeyID, AuthorityKeyID []byte
+	Policies                     []CertPolicy
+	TLSFeatures                  []string
+	Extensions                   []CertExtension
+	PublicKey                    *PublicKeyInfo
+	SubjectAltNames              []GeneralName
+}
+
+// CertExtension represents an extension of a certificate. Name is empty
+// for unrecognised extensions.
+type CertExtension struct {
+	OID      string
+	Name     string
+	Critical bool
+}
+
+// CertPolicy represents a certificate policy with its CPS URIs and user
+// notices. Name is empty for unrecognised policies.
+type CertPolicy struct {
+	OID         string
+	Name        string
+	CPS         []string
+	UserNotices []string
+}
+
+// PublicKeyInfo represents the properties of a public key that determine its
+// strength. Exponent is only set for RSA keys and Curve for ECDSA and Ed25519
+// keys. SecurityLevel is the estimated security strength in bits following NIST
+// SP 800-57 and Strength rates it as "weak" (below 112 bits), "acceptable" (112
+// bits) or "strong".
+type PublicKeyInfo struct {
+	Algorithm     string
+	Bits          int
+	Exponent      int
+	Curve         string
+	SecurityLevel int
+	Strength      string
+}
+
+// DescribeCert returns a *CertDescription with the extensions of a certificate in a
+// human-readable form. Policy qualifiers, TLS features and subject alternative names
+// that can not be decoded are skipped.
+func DescribeCert(cert *x509.Certificate) *CertDescription {
+	desc := CertDescription{
+		BasicConstraintsValid: cert.BasicConstraintsValid,
+		IsCA:                  cert.IsCA,
+		MaxPathLen:            -1,
+		SubjectKeyID:          cert.SubjectKeyId,
+		AuthorityKeyID:        cert.AuthorityKeyId,
+	}
+	if cert.MaxPathLen > 0 || cert.MaxPathLenZero {
+		desc.MaxPathLen = cert.MaxPathLen
+	}
+
+	for idx, name := range keyUsageNames {
+		if cert.KeyUsage&(1<<uint(idx)) != 0 {
+			desc.KeyUsage = append(desc.KeyUsage, name)
+		}
+	}
+
+	for _, eku := range cert.ExtKeyUsage {
+		if name, ok := extKeyUsageNames[eku]; ok {
+			desc.ExtKeyUsage = append(desc.ExtKeyUsage, name)
+		}
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		if name, ok := unknownExtKeyUsageNames[oid.String()]; ok {
+			desc.ExtKeyUsage = append(desc.ExtKeyUsage, name)
+		} else {
+			desc.ExtKeyUsage = append(desc.ExtKeyUsage, oid.String())
+		}
+	}
+
+	for _, ext := range cert.Extensions {
+		desc.Extensions = append(desc.Extensions, CertExtension{
+			OID:      ext.Id.String(),
+			Name:     extensionNames[ext.Id.String()],
+			Critical: ext.Critical,
+		})
+
+		switch {
+		case ext.Id.Equal(oidExtensionCertPolicies):
+			desc.Policies = parsePolicies(ext.Value)
+		case ext.Id.Equal(oidExtensionTLSFeature):
+			desc.TLSFeatures = parseTLSFeatures(ext.Value)
+		}
+	}
+
+	desc.PublicKey, _ = DescribePublicKey(cert.PublicKey)
+	desc.SubjectAltNames, _ = ParseSubjectAltNames(cert)
+
+	if desc.Policies == nil {
+		for _, oid := range cert.PolicyIdentifiers {
+			desc.Policies = append(desc.Policies, CertPolicy{OID: oid.String(), Name: policyNames[oid.String()]})
+		}
+	}
+
+	return &desc
+}
+
+// DescribePublicKey returns a *PublicKeyInfo with the size, curve, exponent and
+// estimated strength of a RSA, ECDSA, Ed25519 or DSA public key and an error if
+// the type of key is not supported.
+func DescribePublicKey(publicKey crypto.PublicKey) (*PublicKeyInfo, error) {
+	var info PublicKeyInfo
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		info.Algorithm = "RSA"
+		info.Bits = key.N.BitLen()
+		info.Exponent = key.E
+		info.SecurityLevel = factoringStrength(info.Bits)
+	case *ecdsa.PublicKey:
+		info.Algorithm = "ECDSA"
+		info.Bits = key.Curve.Params().BitSize
+		info.Curve = key.Curve.Params().Name
+		info.SecurityLevel = curveStrengths[info.Curve]
+	case ed25519.PublicKey:
+		info.Algorithm = "Ed25519"
+		info.Bits = 256
+		info.Curve = "Curve25519"
+		info.SecurityLevel = 128
+	case *dsa.PublicKey:
+		info.Algorithm = "DSA"
+		info.Bits = key.P.BitLen()
+		info.SecurityLevel = factoringStrength(info.Bits)
+	default:
+		return nil, errors.New("unsupported public key type")
+	}
+
+	switch {
+	case info.SecurityLevel < 112:
+		info.Strength = "weak"
+	case info.SecurityLevel < 128:
+		info.Strength = "acceptable"
+	default:
+		info.Strength = "strong"
+	}
+
+	return &info, nil
+}
+
+// decodeDisplayText decodes a DisplayText string, converting BMPString from UTF-16
+func decodeDisplayText(value asn1.RawValue) string {
+	if value.Tag != 30 { // IA5String, VisibleString and UTF8String
+		return string(value.Bytes)
+	}
+
+	var runes []rune
+	for idx := 0; idx+1 < len(value.Bytes); idx += 2 {
+		runes = append(runes, rune(value.Bytes[idx])<<8|rune(value.Bytes[idx+1]))
+	}
+	return string(runes)
+}
+
+// factoringStrength returns the estimated security level of a RSA or DSA key size
+func factoringStrength(bits int) int {
+	for _, entry := range factoringStrengths {
+		if bits >= entry.bits {
+			return entry.strength
+		}
+	}
+	return 0
+}
+
+// parsePolicies decodes the value of the Certificate Policies extension
+func parsePolicies(value []byte) []CertPolicy {
+	var policyInfos []struct {
+		Policy     asn1.ObjectIdentifier
+		Qualifiers []struct {
+			ID        asn1.ObjectIdentifier
+			Qualifier asn1.RawValue
+		} `asn1:"optional"`
+	}
+	if rest, err := asn1.Unmarshal(value, &policyInfos); err != nil || len(rest) != 0 {
+		return nil
+	}
+
+	var policies []CertPolicy
+	for _, info := range policyInfos {
+		policy := CertPolicy{OID: info.Policy.String(), Name: policyNames[info.Policy.String()]}
+		for _, qualifier := range info.Qualifiers {
+			switch {
+			case qualifier.ID.Equal(oidPolicyQualifierCPS):
+				policy.CPS = append(policy.CPS, string(qualifier.Qualifier.Bytes))
+			case qualifier.ID.Equal(oidPolicyQualifierUserNotice):
+				// UserNotice ::= SEQUENCE { noticeRef OPTIONAL, explicitText OPTIONAL }
+				var elems []asn1.RawValue
+				if _, err := asn1.Unmarshal(qualifier.Qualifier.FullBytes, &elems); err != nil {
+					continue
+				}
+				for _, elem := range elems {
+					if !elem.IsCompound {
+						policy.UserNotices = append(policy.UserNotices, decodeDisplayText(elem))
+					}
+				}
+			}
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies
+}
+
+// parseTLSFeatures decodes the value of the TLS Feature extension
+func parseTLSFeatures(value []byte) []string {
+	var features []int
+	if _, err := asn1.Unmarshal(value, &features); err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, feature := range features {
+		if name, ok := tlsFeatureNames[feature]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, "unknown ("+strconv.Itoa(feature)+")")
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,136 @@
+package certmin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/nxadm/certmin/internal/testcert"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeCert(t *testing.T) {
+	certs, err := DecodeCertFile("t/kuleuven-be.pem", "")
+	assert.NoError(t, err)
+	desc := DescribeCert(certs[0])
+	assert.Equal(t, []string{"Digital Signature", "Key Encipherment"}, desc.KeyUsage)
+	assert.Equal(t, []string{"Server Authentication", "Client Authentication"}, desc.ExtKeyUsage)
+	assert.True(t, desc.BasicConstraintsValid)
+	assert.False(t, desc.IsCA)
+	assert.Equal(t, -1, desc.MaxPathLen)
+	assert.Equal(t, 20, len(desc.SubjectKeyID))
+	assert.Equal(t, 20, len(desc.AuthorityKeyID))
+	if assert.Equal(t, 2, len(desc.Policies)) {
+		assert.Equal(t, []string{"https://sectigo.com/CPS"}, desc.Policies[0].CPS)
+		assert.Equal(t, "CA/B Forum Organization Validated", desc.Policies[1].Name)
+	}
+	assert.Contains(t, desc.Extensions, CertExtension{OID: "2.5.29.15", Name: "Key Usage", Critical: true})
+	if assert.NotNil(t, desc.PublicKey) {
+		assert.Equal(t, "RSA", desc.PublicKey.Algorithm)
+	}
+
+	// Generated certificate with unknown extensions
+	mustStaple, _ := asn1.Marshal([]int{5})
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "foo"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		UnknownExtKeyUsage:    []asn1.ObjectIdentifier{{1, 3, 6, 1, 4, 1, 311, 20, 2, 2}, {1, 2, 3, 4}},
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5}, Critical: true, Value: []byte{5, 0}},
+			{Id: oidExtensionTLSFeature, Value: mustStaple},
+		},
+	}
+	cert, _ := testcert.Sign(t, &template, nil, nil)
+	desc = DescribeCert(cert)
+	assert.True(t, desc.IsCA)
+	assert.Equal(t, 0, desc.MaxPathLen)
+	assert.Equal(t, []string{"Microsoft Smartcard Logon", "1.2.3.4"}, desc.ExtKeyUsage)
+	assert.Equal(t, []string{"status_request (OCSP Must-Staple)"}, desc.TLSFeatures)
+	assert.Contains(t, desc.Extensions, CertExtension{OID: "1.2.3.4.5", Critical: true})
+}
+
+func TestDescribePublicKey(t *testing.T) {
+	certs, err := DecodeCertFile("t/myserver.crt", "")
+	assert.NoError(t, err)
+	info, err := DescribePublicKey(certs[0].PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, &PublicKeyInfo{
+		Algorithm: "RSA", Bits: 2048, Exponent: 65537, SecurityLevel: 112, Strength: "acceptable"}, info)
+
+	certs, err = DecodeCertFile("t/ecdsa_secp384r1.crt", "")
+	assert.NoError(t, err)
+	info, err = DescribePublicKey(certs[0].PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, &PublicKeyInfo{
+		Algorithm: "ECDSA", Bits: 384, Curve: "P-384", SecurityLevel: 192, Strength: "strong"}, info)
+
+	key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	assert.NoError(t, err)
+	info, err = DescribePublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, &PublicKeyInfo{
+		Algorithm: "ECDSA", Bits: 521, Curve: "P-521", SecurityLevel: 256, Strength: "strong"}, info)
+
+	certs, err = DecodeCertFile("t/ed25519.crt", "")
+	assert.NoError(t, err)
+	info, err = DescribePublicKey(certs[0].PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "Ed25519", info.Algorithm)
+	assert.Equal(t, 128, info.SecurityLevel)
+
+	_, err = DescribePublicKey("foo")
+	assert.Error(t, err)
+}
+
+func TestDecodeDisplayText(t *testing.T) {
+	assert.Equal(t, "foo", decodeDisplayText(asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte("foo")}))
+	assert.Equal(t, "foé", decodeDisplayText(asn1.RawValue{Tag: 30, Bytes: []byte{0, 'f', 0, 'o', 0, 0xe9}}))
+}
+
+func TestFactoringStrength(t *testing.T) {
+	assert.Equal(t, 0, factoringStrength(384))
+	assert.Equal(t, 80, factoringStrength(1024))
+	assert.Equal(t, 112, factoringStrength(2048))
+	assert.Equal(t, 128, factoringStrength(4096))
+}
+
+func TestParsePolicies(t *testing.T) {
+	notice, _ := asn1.Marshal([]asn1.RawValue{{Tag: asn1.TagUTF8String, Bytes: []byte("foo")}})
+	value, _ := asn1.Marshal([]struct {
+		Policy     asn1.ObjectIdentifier
+		Qualifiers []struct {
+			ID        asn1.ObjectIdentifier
+			Qualifier asn1.RawValue
+		}
+	}{{
+		Policy: asn1.ObjectIdentifier{2, 23, 140, 1, 2, 1},
+		Qualifiers: []struct {
+			ID        asn1.ObjectIdentifier
+			Qualifier asn1.RawValue
+		}{{ID: oidPolicyQualifierUserNotice, Qualifier: asn1.RawValue{FullBytes: notice}}},
+	}})
+	policies := parsePolicies(value)
+	if assert.Equal(t, 1, len(policies)) {
+		assert.Equal(t, "CA/B Forum Domain Validated", policies[0].Name)
+		assert.Equal(t, []string{"foo"}, policies[0].UserNotices)
+	}
+
+	assert.Nil(t, parsePolicies([]byte("foo")))
+}
+
+func TestParseTLSFeatures(t *testing.T) {
+	value, _ := asn1.Marshal([]int{5, 99})
+	assert.Equal(t, []string{"status_request (OCSP Must-Staple)", "unknown (99)"}, parseTLSFeatures(value))
+	assert.Nil(t, parseTLSFeatures([]byte("foo")))
+}
@@ -0,0 +1,30 @@
+package certmin
+
+import (
+	"context"
+	"crypto/x509"
+)
+
+// DownloadCerts downloads a certificate file from a HTTP(S) URL (e.g. the CA file
+// of a PKI), following redirects. The response can be a PEM, DER or PKCS7 file,
+// with the Content-Type used as hint. As parameters it takes the URL (without the
+// get+ prefix of a Location) and a *RetrieveOptions (nil for the defaults) of
+// which the Proxy and Timeout fields are used. The return values are a
+// []*x509.Certificate and an error in case of failure.
+func DownloadCerts(rawURL string, options *RetrieveOptions) ([]*x509.Certificate, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+	return clientForOptions(options).DownloadCerts(context.Background(), rawURL, options)
+}
+
+// DownloadCerts downloads a certificate file like the DownloadCerts function, with
+// a context.Context to cancel the download.
+func (client *Client) DownloadCerts(
+	ctx context.Context, rawURL string, options *RetrieveOptions) ([]*x509.Certificate, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+	certs, _, err := fetchHTTPCerts(ctx, client.httpClientFor(options), rawURL)
+	return certs, err
+}
@@ -0,0 +1,56 @@
+package certmin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nxadm/certmin/internal/testcert"
+	"github.com/stretchr/testify/assert"
+	"go.mozilla.org/pkcs7"
+)
+
+func TestDownloadCerts(t *testing.T) {
+	caBytes, err := ioutil.ReadFile("t/ca.crt")
+	assert.NoError(t, err)
+	root, _ := testcert.Issued(t, "root", true, nil, nil)
+	bundle, err := pkcs7.DegenerateCertificate(root.Raw)
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.Handle("/old", http.RedirectHandler("/ca.crt", http.StatusMovedPermanently))
+	mux.HandleFunc("/ca.crt", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(caBytes)
+	})
+	mux.HandleFunc("/ca.p7c", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/pkcs7-mime")
+		w.Write(bundle)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	options := &RetrieveOptions{Proxy: ProxyDirect}
+
+	certs, err := DownloadCerts(server.URL+"/old", options)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(certs)) {
+		assert.Equal(t, "Easy-RSA CA", certs[0].Subject.CommonName)
+	}
+
+	certs, err = NewClient().DownloadCerts(context.Background(), server.URL+"/ca.p7c", options)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(certs)) {
+		assert.Equal(t, root, certs[0])
+	}
+
+	for _, path := range []string{"/login", "/missing"} {
+		_, err = DownloadCerts(server.URL+path, options)
+		assert.Error(t, err)
+	}
+}
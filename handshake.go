@@ -0,0 +1,199 @@
+package certmin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+// maxRecordedHandshake limits the bytes recorded to find the key exchange group.
+const maxRecordedHandshake = 1 << 16
+
+// curveNames maps the key exchange groups to their names.
+var curveNames = map[tls.CurveID]string{
+	tls.CurveP256: "P-256",
+	tls.CurveP384: "P-384",
+	tls.CurveP521: "P-521",
+	tls.X25519:    "X25519",
+	30:            "X448",
+	0x11ec:        "X25519MLKEM768",
+	0x6399:        "X25519Kyber768Draft00",
+}
+
+// versionNames maps the TLS protocol versions to their names.
+var versionNames = map[uint16]string{
+	0x0300:           "SSL 3.0",
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// HandshakeInfo represents the details of a TLS handshake. KeyExchangeGroup is 0
+// for a RSA key exchange or if not found. ServerName is the name sent as SNI (empty
+// if none). DidResume is set if the session was resumed, ClientCertRequested if the
+// server asked for a client certificate, with the distinguished names of the
+// accepted issuers in AcceptableCAs. ClientCertSent is set if the ClientCertificate
+// of RetrieveOptions was sent and ClientCertAccepted if the server did not reject it.
+// OCSPResponse is the stapled OCSP response, if any.
+type HandshakeInfo struct {
+	Version             uint16
+	CipherSuite         uint16
+	KeyExchangeGroup    tls.CurveID
+	NegotiatedProtocol  string
+	ServerName          string
+	DidResume           bool
+	ClientCertRequested bool
+	AcceptableCAs       []string
+	ClientCertSent      bool
+	ClientCertAccepted  bool
+	OCSPResponse        []byte
+	PeerCertificates    []*x509.Certificate
+}
+
+// recordingConn records the bytes received during the handshake
+type recordingConn struct {
+	net.Conn
+	received []byte
+}
+
+func (conn *recordingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if len(conn.received) < maxRecordedHandshake {
+		conn.received = append(conn.received, b[:n]...)
+	}
+	return n, err
+}
+
+// RetrieveHandshakeInfo retrieves the details of the TLS handshake with the remote
+// host. As parameters it takes an address string like RetrieveCertsFromAddr and a
+// *RetrieveOptions (nil for the defaults). A second connection is made to find out
+// if the server resumes sessions. The return values are a *RetrievalResult, with
+// the details of the handshake in its Handshake field and a failed verification in
+// its VerifyError field, and an error in case of failure.
+func RetrieveHandshakeInfo(addr string, options *RetrieveOptions) (*RetrievalResult, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+	return clientForOptions(options).RetrieveHandshakeInfo(context.Background(), addr, options)
+}
+
+// CipherSuiteName returns the name of the negotiated cipher suite.
+func (info *HandshakeInfo) CipherSuiteName() string {
+	return tls.CipherSuiteName(info.CipherSuite)
+}
+
+// KeyExchangeGroupName returns the name of the key exchange group or an empty
+// string if not known.
+func (info *HandshakeInfo) KeyExchangeGroupName() string {
+	if info.KeyExchangeGroup == 0 {
+		return ""
+	}
+	if name, ok := curveNames[info.KeyExchangeGroup]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", uint16(info.KeyExchangeGroup))
+}
+
+// OCSPStapled returns true if the server stapled an OCSP response.
+func (info *HandshakeInfo) OCSPStapled() bool {
+	return len(info.OCSPResponse) > 0
+}
+
+// VersionName returns the name of the negotiated protocol version.
+func (info *HandshakeInfo) VersionName() string {
+	return versionName(info.Version)
+}
+
+// parseKeyExchangeGroup returns the key exchange group from the plain text handshake
+// messages received from the server: the key_share extension of the ServerHello (TLS
+// 1.3) or the named curve of the ServerKeyExchange (ECDHE in TLS 1.2 and earlier).
+func parseKeyExchangeGroup(received []byte) tls.CurveID {
+	// Handshake messages can span several records
+	var messages []byte
+	for len(received) >= 5 && received[0] == 22 { // handshake records
+		length := int(binary.BigEndian.Uint16(received[3:5]))
+		if len(received) < 5+length {
+			break
+		}
+		messages = append(messages, received[5:5+length]...)
+		received = received[5+length:]
+	}
+
+	var group tls.CurveID
+	for len(messages) >= 4 {
+		length := int(messages[1])<<16 | int(messages[2])<<8 | int(messages[3])
+		if len(messages) < 4+length {
+			break
+		}
+		body := messages[4 : 4+length]
+		switch messages[0] {
+		case 2: // ServerHello and HelloRetryRequest
+			if found := serverHelloKeyShare(body); found != 0 {
+				group = found
+			}
+		case 12: // ServerKeyExchange
+			if len(body) >= 3 && body[0] == 3 { // named_curve
+				group = tls.CurveID(binary.BigEndian.Uint16(body[1:3]))
+			}
+		}
+		messages = messages[4+length:]
+	}
+
+	return group
+}
+
+// rawNamesAsStrings converts DER encoded distinguished names to strings
+func rawNamesAsStrings(rawNames [][]byte) []string {
+	var names []string
+	for _, rawName := range rawNames {
+		var rdn pkix.RDNSequence
+		if _, err := asn1.Unmarshal(rawName, &rdn); err != nil {
+			names = append(names, hex.EncodeToString(rawName))
+			continue
+		}
+		var name pkix.Name
+		name.FillFromRDNSequence(&rdn)
+		names = append(names, name.String())
+	}
+	return names
+}
+
+// serverHelloKeyShare returns the group of the key_share extension of a ServerHello
+func serverHelloKeyShare(body []byte) tls.CurveID {
+	// version (2), random (32), session id (1 + n), cipher suite (2), compression (1)
+	if len(body) < 35 {
+		return 0
+	}
+	offset := 35 + int(body[34]) + 3
+	if len(body) < offset+2 {
+		return 0
+	}
+	extensions := body[offset+2:]
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions[0:2])
+		length := int(binary.BigEndian.Uint16(extensions[2:4]))
+		if len(extensions) < 4+length {
+			return 0
+		}
+		if extType == 51 && length >= 2 { // key_share
+			return tls.CurveID(binary.BigEndian.Uint16(extensions[4:6]))
+		}
+		extensions = extensions[4+length:]
+	}
+	return 0
+}
+
+// versionName returns the name of a TLS protocol version
+func versionName(version uint16) string {
+	if name, ok := versionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
@@ -0,0 +1,171 @@
+package certmin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/nxadm/certmin/internal/testcert"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSelfSignedCert returns a currently valid self-signed certificate, as sessions
+// with expired certificates are not resumed
+func testSelfSignedCert(t *testing.T) tls.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "myserver"},
+		DNSNames:     []string{"myserver"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, key := testcert.Sign(t, template, nil, nil)
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+}
+
+func TestRetrieveHandshakeInfo(t *testing.T) {
+	addr := startTestServerWithConfig(t, nil, &tls.Config{
+		Certificates:     []tls.Certificate{testSelfSignedCert(t)},
+		CurvePreferences: []tls.CurveID{tls.CurveP384},
+		NextProtos:       []string{"h2"},
+	})
+	options := &RetrieveOptions{Timeout: 5 * time.Second, ALPN: []string{"h2", "http/1.1"}}
+	result, err := RetrieveHandshakeInfo(addr, options)
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		assert.Error(t, result.Warning()) // self-signed CA
+		info := result.Handshake
+		assert.Equal(t, "TLS 1.3", info.VersionName())
+		assert.NotEmpty(t, info.CipherSuiteName())
+		assert.Equal(t, "P-384", info.KeyExchangeGroupName())
+		assert.Equal(t, "h2", info.NegotiatedProtocol)
+		assert.Equal(t, "", info.ServerName) // IP address
+		assert.True(t, info.DidResume)
+		assert.False(t, info.ClientCertRequested)
+		assert.False(t, info.OCSPStapled())
+		assert.Equal(t, 1, len(info.PeerCertificates))
+	}
+
+	caBytes, err := ioutil.ReadFile("t/ca.crt")
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caBytes)
+	cert, err := tls.LoadX509KeyPair("t/myserver.crt", "t/myserver.key")
+	assert.NoError(t, err)
+	cert.OCSPStaple = []byte("foo")
+	addr = startTestServerWithConfig(t, nil, &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		MaxVersion:             tls.VersionTLS12,
+		CurvePreferences:       []tls.CurveID{tls.CurveP256},
+		ClientAuth:             tls.RequestClientCert,
+		ClientCAs:              pool,
+		SessionTicketsDisabled: true,
+	})
+	result, err = RetrieveHandshakeInfo(addr, &RetrieveOptions{Timeout: 5 * time.Second})
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		info := result.Handshake
+		assert.Equal(t, "TLS 1.2", info.VersionName())
+		assert.Equal(t, "P-256", info.KeyExchangeGroupName())
+		assert.Equal(t, "", info.NegotiatedProtocol)
+		assert.False(t, info.DidResume)
+		assert.True(t, info.ClientCertRequested)
+		assert.Equal(t, []string{"CN=Easy-RSA CA"}, info.AcceptableCAs)
+		assert.True(t, info.OCSPStapled())
+	}
+
+	_, err = RetrieveHandshakeInfo("127.0.0.1:1", nil)
+	assert.Error(t, err)
+}
+
+func TestRetrieveHandshakeInfo_ClientCertificate(t *testing.T) {
+	clientCert, err := tls.LoadX509KeyPair("t/myserver.crt", "t/myserver.key")
+	assert.NoError(t, err)
+	otherCert, err := tls.LoadX509KeyPair("t/ecdsa_prime256v1.crt", "t/ecdsa_prime256v1.key")
+	assert.NoError(t, err)
+	verify := func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if string(rawCerts[0]) != string(clientCert.Certificate[0]) {
+			return errors.New("unknown client certificate")
+		}
+		return nil
+	}
+
+	addr := startTestServerWithConfig(t, nil,
+		&tls.Config{ClientAuth: tls.RequireAnyClientCert, VerifyPeerCertificate: verify})
+	result, err := RetrieveHandshakeInfo(addr, &RetrieveOptions{ClientCertificate: &clientCert})
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		info := result.Handshake
+		assert.True(t, info.ClientCertRequested)
+		assert.True(t, info.ClientCertSent)
+		assert.True(t, info.ClientCertAccepted)
+	}
+
+	result, err = RetrieveHandshakeInfo(addr, &RetrieveOptions{ClientCertificate: &otherCert})
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		info := result.Handshake
+		assert.True(t, info.ClientCertSent)
+		assert.False(t, info.ClientCertAccepted)
+	}
+
+	result, err = RetrieveHandshakeInfo(addr, nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		info := result.Handshake
+		assert.False(t, info.ClientCertSent)
+		assert.False(t, info.ClientCertAccepted)
+	}
+
+	addr = startTestServerWithConfig(t, nil, &tls.Config{
+		MaxVersion: tls.VersionTLS12, ClientAuth: tls.RequireAnyClientCert, VerifyPeerCertificate: verify})
+	result, err = RetrieveCerts(addr, &RetrieveOptions{ClientCertificate: &clientCert})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, len(result.PeerCertificates))
+	}
+	_, err = RetrieveCerts(addr, &RetrieveOptions{ClientCertificate: &otherCert})
+	assert.Error(t, err)
+}
+
+func TestHandshakeInfo_KeyExchangeGroupName(t *testing.T) {
+	assert.Equal(t, "", (&HandshakeInfo{}).KeyExchangeGroupName())
+	assert.Equal(t, "X25519", (&HandshakeInfo{KeyExchangeGroup: tls.X25519}).KeyExchangeGroupName())
+	assert.Equal(t, "0x1234", (&HandshakeInfo{KeyExchangeGroup: 0x1234}).KeyExchangeGroupName())
+}
+
+func TestHandshakeInfo_VersionName(t *testing.T) {
+	assert.Equal(t, "TLS 1.2", (&HandshakeInfo{Version: tls.VersionTLS12}).VersionName())
+	assert.Equal(t, "0x1234", (&HandshakeInfo{Version: 0x1234}).VersionName())
+}
+
+func TestParseKeyExchangeGroup(t *testing.T) {
+	serverHello := []byte{3, 3}
+	serverHello = append(serverHello, make([]byte, 32)...)              // random
+	serverHello = append(serverHello, 0, 0x13, 0x01, 0)                 // session id, cipher suite, compression
+	serverHello = append(serverHello, 0, 8, 0, 51, 0, 4, 0, 0x17, 0, 0) // key_share
+	message := append([]byte{2, 0, 0, byte(len(serverHello))}, serverHello...)
+	record := append([]byte{22, 3, 3, 0, byte(len(message))}, message...)
+	assert.Equal(t, tls.CurveP256, parseKeyExchangeGroup(record))
+
+	// ServerKeyExchange split over two records
+	message = []byte{12, 0, 0, 4, 3, 0, 0x18, 0}
+	received := append([]byte{22, 3, 3, 0, 3}, message[:3]...)
+	received = append(received, 22, 3, 3, 0, 5)
+	received = append(received, message[3:]...)
+	assert.Equal(t, tls.CurveP384, parseKeyExchangeGroup(received))
+
+	assert.Equal(t, tls.CurveID(0), parseKeyExchangeGroup(nil))
+	assert.Equal(t, tls.CurveID(0), parseKeyExchangeGroup([]byte{23, 3, 3, 0, 1, 0}))
+}
+
+func TestRawNamesAsStrings(t *testing.T) {
+	certs, err := DecodeCertFile("t/ca.crt", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"CN=Easy-RSA CA", "666f6f"},
+		rawNamesAsStrings([][]byte{certs[0].RawSubject, []byte("foo")}))
+}
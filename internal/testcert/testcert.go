@@ -0,0 +1,56 @@
+// Package testcert creates certificates for the tests of certmin and its CLI.
+package testcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Issued creates a certificate, valid for an hour, signed by the issuer
+// (self-signed if nil) with the given Issuing Certificate URLs. It returns the
+// certificate with its key and fails the test on errors.
+func Issued(t testing.TB, cn string, isCA bool, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey,
+	urls ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		IssuingCertificateURL: urls,
+	}
+	return Sign(t, template, issuer, issuerKey)
+}
+
+// Sign creates a certificate from the template with a new P-256 key, signed by
+// the issuer (self-signed if nil). It returns the certificate with its key and
+// fails the test on errors.
+func Sign(t testing.TB, template, issuer *x509.Certificate,
+	issuerKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issuer == nil {
+		issuer, issuerKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
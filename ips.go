@@ -0,0 +1,122 @@
+package certmin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Resolver looks up the IP addresses of a hostname. It is implemented by
+// *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// IPCerts represents the certificates retrieved from one of the IP addresses of a
+// host. Result is the outcome of the retrieval and Err the error in case of failure.
+// Variant is the index of the distinct chain served by the address, in the order in
+// which the chains were found, or -1 if the retrieval failed.
+type IPCerts struct {
+	IP      net.IP
+	Result  *RetrievalResult
+	Err     error
+	Variant int
+}
+
+// RetrieveCertsFromAllIPs retrieves the certificates offered by every IP address
+// (A and AAAA records) of the remote host, sending the same SNI to each of them.
+// As parameters it takes an address string like RetrieveCertsFromAddr and a
+// *RetrieveOptions (nil for the defaults). The ConnectTo field is ignored and the
+// hostname is resolved by the Resolver field (default: net.DefaultResolver). The
+// return values are a []IPCerts in the order of the resolved addresses and an
+// error if the hostname could not be resolved.
+func RetrieveCertsFromAllIPs(addr string, options *RetrieveOptions) ([]IPCerts, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+	return clientForOptions(options).RetrieveCertsFromAllIPs(context.Background(), addr, options)
+}
+
+// RetrieveCertsFromAllIPs retrieves the certificates offered by every IP address
+// of the remote host like the RetrieveCertsFromAllIPs function, with a
+// context.Context to cancel the retrieval. The lookup is limited by the dial
+// time-out of the Client.
+func (client *Client) RetrieveCertsFromAllIPs(
+	ctx context.Context, addr string, options *RetrieveOptions) ([]IPCerts, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+	loc, err := parseRemote(addr)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", addr, err)
+	}
+
+	ips, err := client.resolveIPs(ctx, loc, options)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", loc.Host, err)
+	}
+
+	ipOptions := *options
+	if ipOptions.ServerName == "" {
+		ipOptions.ServerName = loc.ServerName()
+	}
+	var results []IPCerts
+	found := make(map[string]int)
+	for _, ip := range ips {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ipOptions.ConnectTo = net.JoinHostPort(ip.String(), strconv.Itoa(loc.Port))
+		ipCerts := IPCerts{IP: ip, Variant: -1}
+		ipCerts.Result, ipCerts.Err = client.RetrieveCerts(ctx, loc.Addr(), &ipOptions)
+		if ipCerts.Err == nil {
+			key := chainKey(ipCerts.Result.PeerCertificates)
+			idx, ok := found[key]
+			if !ok {
+				idx = len(found)
+				found[key] = idx
+			}
+			ipCerts.Variant = idx
+		}
+		results = append(results, ipCerts)
+	}
+
+	return results, nil
+}
+
+// resolveIPs returns the unique IP addresses of a remote location
+func (client *Client) resolveIPs(ctx context.Context, loc *Location, options *RetrieveOptions) ([]net.IP, error) {
+	if loc.IsIP() {
+		return []net.IP{net.ParseIP(loc.Host)}, nil
+	}
+
+	resolver := options.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if client.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.dialTimeout)
+		defer cancel()
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, loc.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr.IP.String()] {
+			continue
+		}
+		seen[addr.IP.String()] = true
+		ips = append(ips, addr.IP)
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no IP addresses found")
+	}
+	return ips, nil
+}
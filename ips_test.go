@@ -0,0 +1,110 @@
+package certmin
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testResolver resolves every hostname to its IP addresses
+type testResolver []string
+
+func (resolver testResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if len(resolver) == 0 {
+		return nil, errors.New("no such host " + host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range resolver {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestClient_RetrieveCertsFromAllIPs(t *testing.T) {
+	addr := startTestServer(t, nil)
+	var dialed []string
+	dial := func(ctx context.Context, network, dialAddr string) (net.Conn, error) {
+		dialed = append(dialed, dialAddr)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	client := NewClient(WithDialContext(dial), WithTimeout(5*time.Second))
+	options := &RetrieveOptions{Resolver: testResolver{"192.0.2.1", "192.0.2.2"}, Proxy: ProxyDirect}
+	results, err := client.RetrieveCertsFromAllIPs(context.Background(), "myserver:443", options)
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(results)) {
+		assert.NoError(t, results[1].Err)
+		assert.Equal(t, 0, results[1].Variant)
+	}
+	assert.Equal(t, []string{"192.0.2.1:443", "192.0.2.2:443"}, dialed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.RetrieveCertsFromAllIPs(ctx, "myserver:443", options)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestRetrieveCertsFromAllIPs(t *testing.T) {
+	addr := startTestServer(t, nil)
+	_, port, err := net.SplitHostPort(addr)
+	assert.NoError(t, err)
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", port))
+	if err != nil {
+		t.Skip("127.0.0.2 not available: " + err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+	sni := make(chan string, 2)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{testSelfSignedCert(t)},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni <- hello.ServerName
+			return nil, nil
+		},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server := tls.Server(conn, config)
+			if server.Handshake() == nil {
+				server.Read(make([]byte, 1))
+			}
+			conn.Close()
+		}
+	}()
+
+	resolver := testResolver{"127.0.0.1", "127.0.0.2", "127.0.0.1", "127.0.0.3"}
+	options := &RetrieveOptions{Timeout: 5 * time.Second, Resolver: resolver, ConnectTo: "192.0.2.1"}
+	results, err := RetrieveCertsFromAllIPs("myserver:"+port, options)
+	assert.NoError(t, err)
+	if assert.Equal(t, 3, len(results)) {
+		assert.Equal(t, "127.0.0.1", results[0].IP.String())
+		assert.NoError(t, results[0].Err)
+		assert.Equal(t, 0, results[0].Variant)
+		assert.Equal(t, "myserver", results[0].Result.PeerCertificates[0].Subject.CommonName)
+
+		assert.Equal(t, "127.0.0.2", results[1].IP.String())
+		assert.NoError(t, results[1].Err)
+		assert.False(t, results[1].Result.Verified()) // self-signed
+		assert.Equal(t, 1, results[1].Variant)
+		assert.Equal(t, "myserver", <-sni)
+
+		assert.Error(t, results[2].Err)
+		assert.Equal(t, -1, results[2].Variant)
+	}
+
+	_, err = RetrieveCertsFromAllIPs("myserver:"+port, &RetrieveOptions{Resolver: testResolver{}})
+	assert.Error(t, err)
+
+	results, err = RetrieveCertsFromAllIPs(addr, &RetrieveOptions{Resolver: testResolver{}})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(results)) {
+		assert.Equal(t, 0, results[0].Variant)
+	}
+}
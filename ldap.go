@@ -0,0 +1,442 @@
+package certmin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Search scopes of a LDAP URL (RFC 4516)
+const (
+	ldapScopeBase = 0
+	ldapScopeOne  = 1
+	ldapScopeSub  = 2
+)
+
+// ldapIssuerAttributes are the attributes requested if a LDAP URL lists none
+var ldapIssuerAttributes = []string{"cACertificate", "crossCertificatePair"}
+
+// ldapMessage is the envelope of the LDAP requests and responses (RFC 4511)
+type ldapMessage struct {
+	MessageID  int
+	ProtocolOp asn1.RawValue
+}
+
+// ldapAttribute is an attribute of a SearchResultEntry (RFC 4511)
+type ldapAttribute struct {
+	Type   []byte
+	Values [][]byte `asn1:"set"`
+}
+
+// certificatePair is the value of a crossCertificatePair attribute (RFC 4523),
+// with the certificates as the content of the explicitly tagged elements
+type certificatePair struct {
+	Forward asn1.RawValue `asn1:"optional,tag:0"`
+	Reverse asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// ldapURL holds the parts of a LDAP URL (RFC 4516) used to search certificates
+type ldapURL struct {
+	secure     bool
+	hostPort   string
+	dn         string
+	attributes []string
+	scope      int
+	filter     string
+}
+
+// fetchLDAPIssuer searches the certificates of a ldap:// or ldaps:// Issuing
+// Certificate URL with an anonymous bind
+func (client *Client) fetchLDAPIssuer(
+	ctx context.Context, rawURL string, options *RetrieveOptions) ([]*x509.Certificate, error) {
+	search, err := parseLDAPURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if search.hostPort == "" {
+		if client.ldapServer == "" {
+			return nil, errors.New("no LDAP server given for an URL without host")
+		}
+		search.hostPort = client.ldapServer
+		if _, _, err := net.SplitHostPort(search.hostPort); err != nil {
+			scheme := "ldap"
+			if search.secure {
+				scheme = "ldaps"
+			}
+			search.hostPort = net.JoinHostPort(search.hostPort, strconv.Itoa(schemePorts[scheme]))
+		}
+	}
+
+	if client.httpTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.httpTimeout)
+		defer cancel()
+	}
+	rawConn, err := client.dial(ctx, search.hostPort, options.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	defer rawConn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		rawConn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rawConn.SetDeadline(time.Now()) // abort pending I/O
+		case <-stop:
+		}
+	}()
+
+	var conn io.ReadWriter = rawConn
+	if search.secure {
+		host, _, _ := net.SplitHostPort(search.hostPort)
+		conn = tls.Client(rawConn, &tls.Config{ServerName: host, RootCAs: client.rootCAs})
+	}
+	certs, err := ldapSearchCerts(conn, search)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return certs, err
+}
+
+// decodeLDAPCerts decodes the certificates of the values of a cACertificate
+// (DER) or crossCertificatePair attribute, skipping the invalid values
+func decodeLDAPCerts(attrType string, values [][]byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for _, value := range values {
+		ders := [][]byte{value}
+		if strings.EqualFold(attrType, "crossCertificatePair") {
+			var pair certificatePair
+			if _, err := asn1.Unmarshal(value, &pair); err != nil {
+				continue
+			}
+			ders = [][]byte{pair.Forward.Bytes, pair.Reverse.Bytes}
+		}
+		for _, der := range ders {
+			if len(der) == 0 {
+				continue
+			}
+			if cert, err := x509.ParseCertificate(der); err == nil {
+				certs = append(certs, cert)
+			}
+		}
+	}
+	return certs
+}
+
+// encodeLDAPFilter encodes a string filter (RFC 4515) with the and, or, not,
+// equality and presence operators
+func encodeLDAPFilter(filter string) ([]byte, error) {
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	encoded, rest, err := parseLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, errors.New("invalid LDAP filter: " + filter)
+	}
+	return encoded, nil
+}
+
+// ldapResultError returns the error of a LDAPResult (RFC 4511), nil on success
+func ldapResultError(result []byte) error {
+	var resultCode asn1.Enumerated
+	rest, err := asn1.Unmarshal(result, &resultCode)
+	if err != nil {
+		return err
+	}
+	if resultCode != 0 {
+		var matchedDN, diagnostic []byte
+		rest, _ = asn1.Unmarshal(rest, &matchedDN)
+		asn1.Unmarshal(rest, &diagnostic)
+		return fmt.Errorf("result code %d (%s)", resultCode, diagnostic)
+	}
+	return nil
+}
+
+// ldapSearchCerts binds anonymously and returns the certificates of the entries
+// found by the search
+func ldapSearchCerts(conn io.ReadWriter, search *ldapURL) ([]*x509.Certificate, error) {
+	bind, err := marshalConcat(3, []byte{}, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: []byte{}})
+	if err != nil {
+		return nil, err
+	}
+	response, err := ldapRoundTrip(conn, 1, 0, bind)
+	if err != nil {
+		return nil, err
+	}
+	if response.ProtocolOp.Tag != 1 {
+		return nil, errors.New("ldap bind: unexpected response")
+	}
+	if err := ldapResultError(response.ProtocolOp.Bytes); err != nil {
+		return nil, fmt.Errorf("ldap bind: %s", err)
+	}
+
+	filter, err := encodeLDAPFilter(search.filter)
+	if err != nil {
+		return nil, err
+	}
+	var attributes [][]byte
+	for _, attribute := range search.attributes {
+		attributes = append(attributes, []byte(attribute))
+	}
+	request, err := marshalConcat([]byte(search.dn), asn1.Enumerated(search.scope), asn1.Enumerated(0), 0, 0,
+		false, asn1.RawValue{FullBytes: filter}, attributes)
+	if err != nil {
+		return nil, err
+	}
+	response, err = ldapRoundTrip(conn, 2, 3, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for response.ProtocolOp.Tag != 5 { // SearchResultDone
+		if response.ProtocolOp.Tag == 4 { // SearchResultEntry, ignoring references
+			var objectName []byte
+			var entryAttributes []ldapAttribute
+			rest, err := asn1.Unmarshal(response.ProtocolOp.Bytes, &objectName)
+			if err == nil {
+				_, err = asn1.Unmarshal(rest, &entryAttributes)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("ldap search: %s", err)
+			}
+			for _, attribute := range entryAttributes {
+				attrType := strings.SplitN(string(attribute.Type), ";", 2)[0] // e.g. cACertificate;binary
+				certs = append(certs, decodeLDAPCerts(attrType, attribute.Values)...)
+			}
+		}
+		response, err = readLDAPMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("ldap search: %s", err)
+		}
+	}
+	if err := ldapResultError(response.ProtocolOp.Bytes); err != nil {
+		return nil, fmt.Errorf("ldap search: %s", err)
+	}
+
+	if unbind, err := asn1.Marshal(ldapMessage{
+		MessageID: 3, ProtocolOp: asn1.RawValue{Class: asn1.ClassApplication, Tag: 2, Bytes: []byte{}}}); err == nil {
+		conn.Write(unbind)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("ldap search: no certificates found")
+	}
+	return certs, nil
+}
+
+// ldapRoundTrip sends a request with the given protocol operation and content and
+// reads the first response
+func ldapRoundTrip(conn io.ReadWriter, messageID, tag int, content []byte) (*ldapMessage, error) {
+	request, err := asn1.Marshal(ldapMessage{
+		MessageID:  messageID,
+		ProtocolOp: asn1.RawValue{Class: asn1.ClassApplication, Tag: tag, IsCompound: true, Bytes: content},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	return readLDAPMessage(conn)
+}
+
+// marshalConcat concatenates the DER encoding of the values
+func marshalConcat(values ...interface{}) ([]byte, error) {
+	var encoded []byte
+	for _, value := range values {
+		bytes, err := asn1.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, bytes...)
+	}
+	return encoded, nil
+}
+
+// parseLDAPFilter encodes the first filter of the string and returns the rest
+func parseLDAPFilter(filter string) ([]byte, string, error) {
+	if len(filter) < 3 || filter[0] != '(' {
+		return nil, "", errors.New("invalid LDAP filter: " + filter)
+	}
+	filter = filter[1:]
+
+	switch filter[0] {
+	case '&', '|':
+		tag := 0
+		if filter[0] == '|' {
+			tag = 1
+		}
+		var content []byte
+		rest := filter[1:]
+		for strings.HasPrefix(rest, "(") {
+			encoded, next, err := parseLDAPFilter(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			content = append(content, encoded...)
+			rest = next
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("invalid LDAP filter: " + filter)
+		}
+		encoded, err := asn1.Marshal(
+			asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: content})
+		return encoded, rest[1:], err
+	case '!':
+		content, rest, err := parseLDAPFilter(filter[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("invalid LDAP filter: " + filter)
+		}
+		encoded, err := asn1.Marshal(
+			asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: content})
+		return encoded, rest[1:], err
+	}
+
+	end := strings.IndexByte(filter, ')')
+	if end < 0 {
+		return nil, "", errors.New("invalid LDAP filter: " + filter)
+	}
+	item, rest := filter[:end], filter[end+1:]
+	idx := strings.IndexByte(item, '=')
+	if idx <= 0 || strings.ContainsAny(item[:idx], "~<>:") {
+		return nil, "", errors.New("unsupported LDAP filter: " + item)
+	}
+	attribute, value := item[:idx], item[idx+1:]
+	if value == "*" { // present
+		encoded, err := asn1.Marshal(
+			asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 7, Bytes: []byte(attribute)})
+		return encoded, rest, err
+	}
+	if strings.Contains(value, "*") {
+		return nil, "", errors.New("unsupported LDAP filter: " + item)
+	}
+	unescaped, err := unescapeLDAPValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	assertion, err := marshalConcat([]byte(attribute), unescaped)
+	if err != nil {
+		return nil, "", err
+	}
+	encoded, err := asn1.Marshal( // equalityMatch
+		asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: assertion})
+	return encoded, rest, err
+}
+
+// parseLDAPURL parses a ldap:// or ldaps:// URL (RFC 4516). The attributes default
+// to cACertificate and crossCertificatePair, the scope to base and the filter to
+// (objectClass=*).
+func parseLDAPURL(rawURL string) (*ldapURL, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	scheme := strings.ToLower(parsed.Scheme)
+	if scheme != "ldap" && scheme != "ldaps" {
+		return nil, errors.New("not a LDAP URL: " + rawURL)
+	}
+
+	search := ldapURL{
+		secure:     scheme == "ldaps",
+		hostPort:   parsed.Host,
+		dn:         strings.TrimPrefix(parsed.Path, "/"),
+		attributes: ldapIssuerAttributes,
+		scope:      ldapScopeBase,
+		filter:     "(objectClass=*)",
+	}
+	if search.hostPort != "" && parsed.Port() == "" {
+		search.hostPort = net.JoinHostPort(parsed.Hostname(), strconv.Itoa(schemePorts[scheme]))
+	}
+
+	var parts []string
+	if parsed.RawQuery != "" {
+		parts = strings.Split(parsed.RawQuery, "?")
+	}
+	for idx, part := range parts {
+		part, err = url.PathUnescape(part)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case part == "":
+			continue
+		case idx == 0:
+			search.attributes = strings.Split(part, ",")
+		case idx == 1:
+			switch strings.ToLower(part) {
+			case "base":
+				search.scope = ldapScopeBase
+			case "one":
+				search.scope = ldapScopeOne
+			case "sub":
+				search.scope = ldapScopeSub
+			default:
+				return nil, errors.New("invalid LDAP scope: " + part)
+			}
+		case idx == 2:
+			search.filter = part
+		case strings.HasPrefix(part, "!"):
+			return nil, errors.New("unsupported critical LDAP extension: " + part)
+		}
+	}
+
+	return &search, nil
+}
+
+// readLDAPMessage reads a LDAP response
+func readLDAPMessage(reader io.Reader) (*ldapMessage, error) {
+	element, err := readBERElement(reader)
+	if err != nil {
+		return nil, err
+	}
+	var message ldapMessage
+	if _, err := asn1.Unmarshal(element, &message); err != nil {
+		return nil, err
+	}
+	if message.ProtocolOp.Class != asn1.ClassApplication {
+		return nil, errors.New("unexpected response")
+	}
+	return &message, nil
+}
+
+// unescapeLDAPValue decodes the \XX escapes of a filter value (RFC 4515)
+func unescapeLDAPValue(value string) ([]byte, error) {
+	var unescaped []byte
+	for idx := 0; idx < len(value); idx++ {
+		if value[idx] != '\\' {
+			unescaped = append(unescaped, value[idx])
+			continue
+		}
+		if idx+3 > len(value) {
+			return nil, errors.New("invalid escape in LDAP filter value: " + value)
+		}
+		decoded, err := hex.DecodeString(value[idx+1 : idx+3])
+		if err != nil {
+			return nil, errors.New("invalid escape in LDAP filter value: " + value)
+		}
+		unescaped = append(unescaped, decoded...)
+		idx += 2
+	}
+	return unescaped, nil
+}
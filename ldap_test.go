@@ -0,0 +1,172 @@
+package certmin
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"net"
+	"testing"
+
+	"github.com/nxadm/certmin/internal/testcert"
+	"github.com/stretchr/testify/assert"
+)
+
+// testLDAPMessage marshals a LDAP response
+func testLDAPMessage(messageID, tag int, content []byte) []byte {
+	message, _ := asn1.Marshal(ldapMessage{
+		MessageID:  messageID,
+		ProtocolOp: asn1.RawValue{Class: asn1.ClassApplication, Tag: tag, IsCompound: true, Bytes: content},
+	})
+	return message
+}
+
+// testCertificatePair marshals a crossCertificatePair value
+func testCertificatePair(forward, reverse []byte) []byte {
+	var content []byte
+	for tag, cert := range [][]byte{forward, reverse} {
+		if cert != nil {
+			element, _ := asn1.Marshal(
+				asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: cert})
+			content = append(content, element...)
+		}
+	}
+	pair, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: content})
+	return pair
+}
+
+// startTestLDAPServer starts a LDAP stand-in answering the search with an entry
+// with the given attributes and sending the received search requests to the
+// channel. It returns the address of the server.
+func startTestLDAPServer(t *testing.T, attributes []ldapAttribute, searches chan []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	success, _ := marshalConcat(asn1.Enumerated(0), []byte{}, []byte{})
+	objectName, _ := asn1.Marshal([]byte("CN=Test CA,DC=example,DC=com"))
+	encodedAttributes, _ := asn1.Marshal(attributes)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := readLDAPMessage(conn); err == nil { // bind
+				conn.Write(testLDAPMessage(1, 1, success))
+			}
+			if search, err := readLDAPMessage(conn); err == nil {
+				searches <- search.ProtocolOp.Bytes
+				conn.Write(testLDAPMessage(2, 4, append(objectName, encodedAttributes...)))
+				conn.Write(testLDAPMessage(2, 19, nil)) // reference
+				conn.Write(testLDAPMessage(2, 5, success))
+			}
+			readLDAPMessage(conn) // unbind
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClient_FetchLDAPIssuer(t *testing.T) {
+	root, rootKey := testcert.Issued(t, "root", true, nil, nil)
+	inter, interKey := testcert.Issued(t, "inter", true, root, rootKey)
+	pair := testCertificatePair(nil, root.Raw)
+	searches := make(chan []byte, 2)
+	addr := startTestLDAPServer(t, []ldapAttribute{
+		{Type: []byte("cACertificate;binary"), Values: [][]byte{inter.Raw}},
+		{Type: []byte("crossCertificatePair"), Values: [][]byte{pair, []byte("invalid")}},
+	}, searches)
+
+	issuerURL := "ldap:///CN=Test%20CA,DC=example,DC=com?cACertificate?base?objectClass=certificationAuthority"
+	leaf, _ := testcert.Issued(t, "leaf", true, inter, interKey, issuerURL)
+	client := NewClient(WithLDAPServer(addr))
+	chain, hops, err := client.RetrieveChainWithTrace(context.Background(), leaf, &RetrieveOptions{Proxy: ProxyDirect})
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{leaf, inter, root}, chain)
+	if assert.Equal(t, 1, len(hops)) {
+		assert.Equal(t, issuerURL, hops[0].URL)
+		assert.Equal(t, 2, len(hops[0].Certs))
+		assert.Empty(t, hops[0].ContentType)
+	}
+	assert.Contains(t, string(<-searches), "CN=Test CA,DC=example,DC=com")
+
+	// The host of the URL is used over the LDAP server
+	certs, err := NewClient().fetchLDAPIssuer(context.Background(), "ldap://"+addr+"/CN=Test%20CA",
+		&RetrieveOptions{Proxy: ProxyDirect})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(certs))
+	assert.Contains(t, string(<-searches), "crossCertificatePair")
+
+	_, err = NewClient().fetchLDAPIssuer(context.Background(), issuerURL, &RetrieveOptions{Proxy: ProxyDirect})
+	assert.Error(t, err)
+
+	// A shared IssuerCache is keyed by the LDAP server of host-less URLs
+	cache := NewIssuerCache()
+	hop := NewClient(WithLDAPServer(addr), WithIssuerCache(cache)).fetchIssuer(
+		context.Background(), nil, &RetrieveOptions{Proxy: ProxyDirect}, issuerURL)
+	assert.NoError(t, hop.Err)
+	<-searches
+	hop = NewClient(WithLDAPServer(addr), WithIssuerCache(cache)).fetchIssuer(
+		context.Background(), nil, &RetrieveOptions{Proxy: ProxyDirect}, issuerURL)
+	assert.True(t, hop.Cached)
+	hop = NewClient(WithLDAPServer("127.0.0.1:1"), WithIssuerCache(cache)).fetchIssuer(
+		context.Background(), nil, &RetrieveOptions{Proxy: ProxyDirect}, issuerURL)
+	assert.False(t, hop.Cached)
+	assert.Error(t, hop.Err)
+}
+
+func TestDecodeLDAPCerts(t *testing.T) {
+	cert, _ := testcert.Issued(t, "cert", true, nil, nil)
+	pair := testCertificatePair(cert.Raw, nil)
+	assert.Equal(t, 1, len(decodeLDAPCerts("cACertificate", [][]byte{cert.Raw, []byte("invalid")})))
+	assert.Equal(t, 1, len(decodeLDAPCerts("crossCertificatePair", [][]byte{pair})))
+	assert.Empty(t, decodeLDAPCerts("crossCertificatePair", [][]byte{cert.Raw[:10]}))
+}
+
+func TestEncodeLDAPFilter(t *testing.T) {
+	present, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 7, Bytes: []byte("objectClass")})
+	encoded, err := encodeLDAPFilter("objectClass=*")
+	assert.NoError(t, err)
+	assert.Equal(t, present, encoded)
+
+	assertion, _ := marshalConcat([]byte("cn"), []byte("a*b"))
+	equality, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true,
+		Bytes: assertion})
+	not, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true,
+		Bytes: equality})
+	and, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true,
+		Bytes: append(append([]byte{}, present...), not...)})
+	encoded, err = encodeLDAPFilter(`(&(objectClass=*)(!(cn=a\2ab)))`)
+	assert.NoError(t, err)
+	assert.Equal(t, and, encoded)
+
+	for _, filter := range []string{"", "(cn=a", "(cn=a)(cn=b)", "(cn=a*)", "(cn>=a)", `(cn=\2)`, "(&(cn=a)"} {
+		_, err = encodeLDAPFilter(filter)
+		assert.Error(t, err, filter)
+	}
+}
+
+func TestParseLDAPURL(t *testing.T) {
+	search, err := parseLDAPURL(
+		"ldap:///CN=AIA,CN=Public%20Key%20Services,DC=example?cACertificate?base?objectClass=certificationAuthority")
+	assert.NoError(t, err)
+	assert.Equal(t, &ldapURL{
+		dn:         "CN=AIA,CN=Public Key Services,DC=example",
+		attributes: []string{"cACertificate"},
+		scope:      ldapScopeBase,
+		filter:     "objectClass=certificationAuthority",
+	}, search)
+
+	search, err = parseLDAPURL("ldaps://ldap.example.com/DC=example??sub")
+	assert.NoError(t, err)
+	assert.True(t, search.secure)
+	assert.Equal(t, "ldap.example.com:636", search.hostPort)
+	assert.Equal(t, ldapIssuerAttributes, search.attributes)
+	assert.Equal(t, ldapScopeSub, search.scope)
+	assert.Equal(t, "(objectClass=*)", search.filter)
+
+	for _, rawURL := range []string{"http://example.com", "ldap:///DC=example??all", "ldap:///DC=x????!bindname=x"} {
+		_, err = parseLDAPURL(rawURL)
+		assert.Error(t, err, rawURL)
+	}
+}
@@ -0,0 +1,204 @@
+package certmin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// downloadPrefix marks HTTP(S) URLs of certificate files to download, e.g.
+// get+https://pki.example.com/ca.crt
+const downloadPrefix = "get+"
+
+// fallbackPort is used for remote locations without a port and an unknown scheme
+const fallbackPort = 443
+
+// schemePorts are the default ports of schemes that are not reliably
+// found in the services database of all systems
+var schemePorts = map[string]int{
+	"ftp":         21,
+	"ftps":        990,
+	"https":       443,
+	"imap":        143,
+	"imaps":       993,
+	"ldap":        389,
+	"ldaps":       636,
+	"mysql":       3306,
+	"pop3":        110,
+	"pop3s":       995,
+	"postgres":    5432,
+	"postgresql":  5432,
+	"smtp":        25,
+	"smtps":       465,
+	"submission":  587,
+	"xmpp":        5222,
+	"xmpp-client": 5222,
+	"xmpp-server": 5269,
+}
+
+// Location represents the location of certificates: a local file, a file to
+// download or a remote address. URL holds the HTTP(S) URL of a download. For
+// remote locations Host holds the hostname or IP address (without the brackets of
+// IPv6 literals) and Port the explicit port or the default port of the scheme.
+// Scheme is only set for URLs and StartTLS holds the protocol derived from it
+// (e.g. StartTLSSMTP for smtp://).
+type Location struct {
+	File     string
+	URL      string
+	Scheme   string
+	Host     string
+	Port     int
+	StartTLS string
+}
+
+// ParseLocation parses a certificate location. The input can be an existing
+// file, a hostname or IP address with optionally a port attached by ":" (IPv6
+// addresses with a port between brackets, e.g. [2001:db8::1]:8443) or an URL
+// (scheme://hostname[:port]). HTTP(S) URLs prefixed with "get+" (e.g.
+// get+https://pki.example.com/ca.crt) are files to download. The return values
+// are a *Location and an error if the input is not a file nor a valid remote
+// location.
+func ParseLocation(input string) (*Location, error) {
+	if _, err := os.Stat(input); err == nil {
+		return &Location{File: input}, nil
+	}
+	if strings.HasPrefix(strings.ToLower(input), "file://") {
+		return &Location{File: input[len("file://"):]}, nil
+	}
+	if strings.HasPrefix(strings.ToLower(input), downloadPrefix) {
+		return parseDownload(input[len(downloadPrefix):])
+	}
+
+	loc, err := parseRemote(input)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a file or a remote location (%s)", input, err)
+	}
+	return loc, nil
+}
+
+// Addr returns the hostname:port address of a remote location.
+func (loc *Location) Addr() string {
+	return net.JoinHostPort(loc.Host, strconv.Itoa(loc.Port))
+}
+
+// IsDownload returns true if the location is a HTTP(S) URL of a file to download.
+func (loc *Location) IsDownload() bool {
+	return loc.URL != ""
+}
+
+// IsIP returns true if the host of a remote location is an IP address.
+func (loc *Location) IsIP() bool {
+	return net.ParseIP(loc.Host) != nil
+}
+
+// IsRemote returns true if the location is a remote address.
+func (loc *Location) IsRemote() bool {
+	return loc.File == "" && loc.URL == ""
+}
+
+// ServerName returns the name to send as SNI: the hostname without a trailing
+// dot or an empty string for IP addresses.
+func (loc *Location) ServerName() string {
+	if loc.IsIP() {
+		return ""
+	}
+	return strings.TrimSuffix(loc.Host, ".")
+}
+
+// String returns the file name, the URL or the address of the location.
+func (loc *Location) String() string {
+	switch {
+	case loc.IsDownload():
+		return loc.URL
+	case loc.IsRemote():
+		return loc.Addr()
+	}
+	return loc.File
+}
+
+// parseDownload parses the HTTP(S) URL of a file to download
+func parseDownload(input string) (*Location, error) {
+	parsedURL, err := url.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	scheme := strings.ToLower(parsedURL.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("%s is not a HTTP(S) URL", input)
+	}
+	if parsedURL.Hostname() == "" {
+		return nil, fmt.Errorf("%s has no hostname", input)
+	}
+	return &Location{URL: input}, nil
+}
+
+// parseRemote parses a remote location (URL, host, host:port or IP literal)
+func parseRemote(input string) (*Location, error) {
+	var loc Location
+	var portStr string
+	if strings.Contains(input, "://") {
+		parsedURL, err := url.Parse(input)
+		if err != nil {
+			return nil, err
+		}
+		loc.Scheme = strings.ToLower(parsedURL.Scheme)
+		loc.StartTLS = StartTLSFromScheme(loc.Scheme)
+		loc.Host = parsedURL.Hostname()
+		portStr = parsedURL.Port()
+	} else {
+		hostPort := input
+		if idx := strings.Index(hostPort, "/"); idx >= 0 {
+			hostPort = hostPort[:idx]
+		}
+		host, port, err := net.SplitHostPort(hostPort)
+		bracketed := strings.HasPrefix(hostPort, "[") && strings.HasSuffix(hostPort, "]")
+		switch {
+		case err == nil:
+			loc.Host, portStr = host, port
+		case bracketed && net.ParseIP(hostPort[1:len(hostPort)-1]) != nil:
+			loc.Host = hostPort[1 : len(hostPort)-1]
+		case net.ParseIP(hostPort) != nil:
+			loc.Host = hostPort
+		case !strings.ContainsAny(hostPort, ":[]"):
+			loc.Host = hostPort
+		default:
+			return nil, err
+		}
+	}
+
+	if loc.Host == "" {
+		return nil, errors.New("no hostname found")
+	}
+	if strings.ContainsAny(loc.Host, " \t\r\n[]/\\@") {
+		return nil, fmt.Errorf("invalid hostname (%s)", loc.Host)
+	}
+
+	if portStr == "" {
+		loc.Port = defaultPort(loc.Scheme)
+		return &loc, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port (%s)", portStr)
+	}
+	loc.Port = port
+
+	return &loc, nil
+}
+
+// defaultPort returns the port of a scheme, with fallbackPort if not known
+func defaultPort(scheme string) int {
+	if port, ok := schemePorts[scheme]; ok {
+		return port
+	}
+	if scheme != "" {
+		if port, err := net.LookupPort("tcp", scheme); err == nil {
+			return port
+		}
+	}
+	return fallbackPort
+}
@@ -0,0 +1,106 @@
+package certmin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLocation(t *testing.T) {
+	loc, err := ParseLocation("location.go")
+	assert.NoError(t, err)
+	assert.False(t, loc.IsRemote())
+	assert.Equal(t, "location.go", loc.String())
+
+	loc, err = ParseLocation("file://t/myserver.crt")
+	assert.NoError(t, err)
+	assert.Equal(t, "t/myserver.crt", loc.File)
+
+	loc, err = ParseLocation("https://foo.fa/bar?baz")
+	assert.NoError(t, err)
+	assert.True(t, loc.IsRemote())
+	assert.Equal(t, "foo.fa:443", loc.Addr())
+	assert.Equal(t, "https", loc.Scheme)
+
+	loc, err = ParseLocation("foo/fa")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo:443", loc.Addr())
+
+	loc, err = ParseLocation("[2001:db8::1]:8443")
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", loc.Host)
+	assert.Equal(t, 8443, loc.Port)
+	assert.Equal(t, "[2001:db8::1]:8443", loc.String())
+
+	loc, err = ParseLocation("get+https://pki.example.com/ca.crt")
+	assert.NoError(t, err)
+	assert.True(t, loc.IsDownload())
+	assert.False(t, loc.IsRemote())
+	assert.Equal(t, "https://pki.example.com/ca.crt", loc.String())
+
+	_, err = ParseLocation("foo:abc123")
+	assert.Error(t, err)
+	_, err = ParseLocation("get+ftp://pki.example.com/ca.crt")
+	assert.Error(t, err)
+	_, err = ParseLocation("get+https:///ca.crt")
+	assert.Error(t, err)
+}
+
+func TestLocation_ServerName(t *testing.T) {
+	for input, expected := range map[string]string{
+		"example.com.":          "example.com",
+		"example.com.:8443":     "example.com",
+		"smtp://example.com":    "example.com",
+		"192.0.2.1:443":         "",
+		"2001:db8::1":           "",
+		"https://[2001:db8::1]": "",
+	} {
+		loc, err := parseRemote(input)
+		if assert.NoError(t, err, input) {
+			assert.Equal(t, expected, loc.ServerName(), input)
+		}
+	}
+}
+
+func TestParseRemote(t *testing.T) {
+	for input, expected := range map[string]string{
+		"https://foo":            "foo:443",
+		"ldaps://foo":            "foo:636",
+		"submission://foo":       "foo:587",
+		"postgres://foo":         "foo:5432",
+		"xmpp-server://foo":      "foo:5269",
+		"foo://foo":              "foo:443",
+		"https://foo:123":        "foo:123",
+		"foo://foo:123":          "foo:123",
+		"BLAH:123":               "BLAH:123",
+		"BLAH.BOE":               "BLAH.BOE:443",
+		"2001:db8::1":            "[2001:db8::1]:443",
+		"[2001:db8::1]":          "[2001:db8::1]:443",
+		"[2001:db8::1]:8443":     "[2001:db8::1]:8443",
+		"smtp://[2001:db8::1]":   "[2001:db8::1]:25",
+		"192.0.2.1":              "192.0.2.1:443",
+		"example.com.:8443/path": "example.com.:8443",
+	} {
+		loc, err := parseRemote(input)
+		if assert.NoError(t, err, input) {
+			assert.Equal(t, expected, loc.Addr(), input)
+		}
+	}
+
+	loc, err := parseRemote("smtp://foo")
+	assert.NoError(t, err)
+	assert.Equal(t, StartTLSSMTP, loc.StartTLS)
+
+	for _, input := range []string{
+		"foo://foo:1AA23", "foo:70000", "https://", "[2001:db8::1", "foo bar", "2001:db8::zz",
+	} {
+		_, err := parseRemote(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestDefaultPort(t *testing.T) {
+	assert.Equal(t, 443, defaultPort(""))
+	assert.Equal(t, 25, defaultPort("smtp"))
+	assert.Equal(t, 443, defaultPort("foo"))
+}
@@ -1,35 +1,61 @@
 package certmin
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"net/http"
-	"regexp"
+	"strings"
 	"time"
 )
 
+// RetrieveOptions represents the options used to retrieve certificates from a
+// remote host. Timeout is used for both the TCP and the SSL connection, with 0
+// disabling it (a Client uses its own time-outs instead). StartTLS selects the
+// protocol (e.g. StartTLSSMTP) used to upgrade a plain text connection to TLS,
+// with an empty string for connections that start with TLS. ServerName overrides
+// the name sent as SNI and used to verify the certificate (default: the hostname
+// of the address, without SNI for IP addresses), while NoSNI omits the SNI
+// extension from the handshake. ConnectTo is an ip[:port] address connected to
+// instead of the address, e.g. to test a backend before a DNS change. Proxy is
+// the URL of a HTTP CONNECT (http://[user:password@]host[:port]) or SOCKS5 proxy
+// (socks5://[user:password@]host[:port]), with an empty string for the proxy set
+// in the HTTPS_PROXY, ALL_PROXY and NO_PROXY environment variables and
+// ProxyDirect to connect directly. ALPN lists the application protocols (e.g.
+// "h2") offered in the handshake. ClientCertificate is sent if the server
+// requests a client certificate. Resolver looks up the IP addresses of the host
+// for RetrieveCertsFromAllIPs.
+type RetrieveOptions struct {
+	Timeout    time.Duration
+	StartTLS   string
+	ServerName string
+	NoSNI      bool
+	ConnectTo  string
+	Proxy      string
+	ALPN       []string
+
+	ClientCertificate *tls.Certificate
+	Resolver          Resolver
+}
+
 // RetrieveCertsFromAddr retrieves all the certificates offered by the remote host. As parameters
-// it takes an address string in the form of hostname:port and a time-out duration for the
+// it takes an address string in the form of hostname:port (see ParseLocation for the accepted
+// forms, e.g. [2001:db8::1]:443) and a time-out duration for the
 // connection. The time-out is used for both the TCP and the SSL connection, with 0 disabling it.
 // The return values are a []*x509.Certificate (with the first element being the certificate
 // of the server), an error with a warning (e.g. mismatch between the hostname and the CN or DNS alias
 // in the certificate) and an error in case of failure.
+//
+// Deprecated: use RetrieveCerts or Client.RetrieveCerts, whose RetrievalResult also
+// holds the verified chains and a typed verification error.
 func RetrieveCertsFromAddr(addr string, timeOut time.Duration) ([]*x509.Certificate, error, error) {
-	var certs []*x509.Certificate
-	var err, warn error
-	certs, warn = connectAndRetrieve(addr, timeOut, false)
-	if warn != nil {
-		certs, err = connectAndRetrieve(addr, timeOut, true)
-		if err != nil {
-			warn = nil
-		}
+	result, err := RetrieveCerts(addr, &RetrieveOptions{Timeout: timeOut})
+	if err != nil {
+		return nil, nil, err
 	}
-
-	return certs, warn, err
+	return result.PeerCertificates, result.Warning(), nil
 }
 
 // RetrieveChainFromIssuerURLs retrieves the chain for a certificate by following the
@@ -37,70 +63,208 @@ func RetrieveCertsFromAddr(addr string, timeOut time.Duration) ([]*x509.Certific
 // following the Issuing Certificate URLs from issuing certificates. As parameters
 // it takes a *x509.Certificate and a time-out duration for the HTTP connection with
 // 0 disabling it. The return values are a []*x509.Certificate (with the first element
-// being the supplied certificate) and an error in case of failure.
+// being the supplied certificate) and an error in case of failure. Use
+// Client.RetrieveChainFromIssuerURLs to set a proxy or a context.Context.
 func RetrieveChainFromIssuerURLs(cert *x509.Certificate, timeOut time.Duration) ([]*x509.Certificate, error) {
-	var chain []*x509.Certificate
-	var lastErr error
-	recursiveHopCerts(cert, &chain, &lastErr, timeOut)
-	return chain, lastErr
+	options := &RetrieveOptions{Timeout: timeOut}
+	return clientForOptions(options).RetrieveChainFromIssuerURLs(context.Background(), cert, options)
+}
+
+// handshake connects to the remote host, retrying failed connections, and returns
+// the outcome of the TLS handshake. The TLS configuration can be adjusted by
+// configure if not nil.
+func (client *Client) handshake(ctx context.Context,
+	addr string, options *RetrieveOptions, configure func(*tls.Config)) (*RetrievalResult, error) {
+	result, err, retry := client.tryHandshake(ctx, addr, options, configure)
+	for attempt := 1; retry && attempt <= client.retries; attempt++ {
+		if !client.wait(ctx, attempt) {
+			return nil, ctx.Err()
+		}
+		result, err, retry = client.tryHandshake(ctx, addr, options, configure)
+	}
+	return result, err
 }
 
-// connectAndRetrieve does the actual TLS calls
-func connectAndRetrieve(addr string, timeOut time.Duration, skipVerify bool) ([]*x509.Certificate, error) {
-	serverName := regexp.MustCompile(`:\d+$`).ReplaceAllString(addr, "")
-	var tlsConfig tls.Config
-	if skipVerify {
-		tlsConfig.InsecureSkipVerify = true
-	} else {
+// tryHandshake makes a single handshake, verifying the certificates of the server
+// without aborting the handshake. The returned bool is set if the connection failed
+// before the handshake completed and can be retried.
+func (client *Client) tryHandshake(ctx context.Context,
+	addr string, options *RetrieveOptions, configure func(*tls.Config)) (*RetrievalResult, error, bool) {
+	loc, err := parseRemote(addr)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", addr, err), false
+	}
+	serverName := loc.ServerName()
+	noSNI := options.NoSNI
+	switch {
+	case options.ServerName != "":
+		serverName = options.ServerName
+	case loc.IsIP():
+		serverName = loc.Host // verified against the IP addresses of the certificate
+		noSNI = true
+	}
+	var result RetrievalResult
+	var info HandshakeInfo
+	tlsConfig := tls.Config{
+		// Verified by VerifyPeerCertificate, as crypto/tls aborts the handshake
+		// if the verification fails
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			chains, err := verifyPeerCerts(rawCerts, serverName, client.rootCAs)
+			if err != nil {
+				result.VerifyError = newVerificationError(err)
+			}
+			result.VerifiedChains = chains
+			return nil
+		},
+		NextProtos: options.ALPN,
+		GetClientCertificate: func(request *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			info.ClientCertRequested = true
+			info.AcceptableCAs = rawNamesAsStrings(request.AcceptableCAs)
+			if options.ClientCertificate == nil {
+				return &tls.Certificate{}, nil
+			}
+			info.ClientCertSent = true
+			return options.ClientCertificate, nil
+		},
+	}
+	if !noSNI {
 		tlsConfig.ServerName = serverName
 	}
 
-	dialer := &net.Dialer{Timeout: timeOut}
-	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tlsConfig)
+	connectAddr, err := connectToAddr(loc.Addr(), options.ConnectTo)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", serverName, err), false
+	}
+	start := time.Now()
+	rawConn, err := client.dial(ctx, connectAddr, options.Proxy)
+	result.DialTime = time.Since(start)
 	if err != nil {
-		return nil, fmt.Errorf("[%s] %s", serverName, err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err(), false
+		}
+		return nil, fmt.Errorf("[%s] %s", serverName, err), true
+	}
+	defer rawConn.Close()
+	result.RemoteAddr = rawConn.RemoteAddr().String()
+	start = time.Now()
+	deadline, hasDeadline := ctx.Deadline()
+	if client.handshakeTimeout > 0 {
+		timeOut := time.Now().Add(client.handshakeTimeout)
+		if !hasDeadline || timeOut.Before(deadline) {
+			deadline, hasDeadline = timeOut, true
+		}
 	}
-	defer conn.Close()
+	if hasDeadline {
+		rawConn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rawConn.SetDeadline(time.Now()) // abort pending I/O
+		case <-stop:
+		}
+	}()
 
-	if len(conn.ConnectionState().PeerCertificates) == 0 {
-		return nil, errors.New("no certificates found")
+	if options.StartTLS != "" {
+		if err := startTLS(rawConn, options.StartTLS, serverName); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err(), false
+			}
+			return nil, fmt.Errorf("[%s] %s", serverName, err), isTimeout(err)
+		}
 	}
 
-	return conn.ConnectionState().PeerCertificates, nil
-}
+	if configure != nil {
+		configure(&tlsConfig)
+	}
+	recorder := &recordingConn{Conn: rawConn}
+	conn := tls.Client(recorder, &tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err(), false
+		}
+		return nil, fmt.Errorf("[%s] %s", serverName, err), isTimeout(err)
+	}
+	result.HandshakeTime = time.Since(start)
 
-// recursiveHopCerts follows the URL links recursively
-func recursiveHopCerts(
-	cert *x509.Certificate, chain *[]*x509.Certificate, lastErr *error, timeOut time.Duration) *x509.Certificate {
-	if cert == nil {
-		return nil
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("no certificates found"), false
 	}
+	info.Version = state.Version
+	info.CipherSuite = state.CipherSuite
+	info.KeyExchangeGroup = parseKeyExchangeGroup(recorder.received)
+	info.NegotiatedProtocol = state.NegotiatedProtocol
+	info.ServerName = tlsConfig.ServerName
+	info.DidResume = state.DidResume
+	info.OCSPResponse = state.OCSPResponse
+	info.PeerCertificates = state.PeerCertificates
 
-	client := http.Client{Timeout: timeOut}
-	*chain = append(*chain, cert)
-	for _, url := range cert.IssuingCertificateURL {
-		resp, err := client.Get(url)
-		if err != nil {
-			*lastErr = err
-			continue
+	info.ClientCertAccepted = info.ClientCertSent
+	waitForTickets := tlsConfig.ClientSessionCache != nil && !state.DidResume
+	if state.Version >= tls.VersionTLS13 && (waitForTickets || info.ClientCertSent) {
+		// TLS 1.3 session tickets and the rejection of the client certificate
+		// are sent after the handshake
+		wait := time.Now().Add(500 * time.Millisecond)
+		if client.handshakeTimeout > 0 && client.handshakeTimeout < 500*time.Millisecond {
+			wait = time.Now().Add(client.handshakeTimeout)
 		}
-
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			*lastErr = err
-			continue
+		conn.SetReadDeadline(wait)
+		_, err := conn.Read(make([]byte, 1))
+		if err != nil && !isTimeout(err) {
+			info.ClientCertAccepted = false
 		}
-		defer resp.Body.Close()
+	}
+
+	result.PeerCertificates = state.PeerCertificates
+	result.Handshake = &info
+	return &result, nil, false
+}
+
+// connectToAddr returns the address to dial: addr or, if given, the ip[:port]
+// connectTo address with the port of addr as default.
+func connectToAddr(addr, connectTo string) (string, error) {
+	if connectTo == "" {
+		return addr, nil
+	}
+	if _, _, err := net.SplitHostPort(connectTo); err == nil {
+		return connectTo, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(strings.Trim(connectTo, "[]"), port), nil
+}
+
+// isTimeout returns true for network time-outs
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
 
-		decodedCerts, err := DecodeCertBytes(bodyBytes, "")
+// verifyPeerCerts verifies the certificates offered by the server for serverName
+// against roots (nil for the system roots) like crypto/tls does and returns the
+// verified chains
+func verifyPeerCerts(rawCerts [][]byte, serverName string, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
 		if err != nil {
-			*lastErr = err
-			continue
+			return nil, err
 		}
-
-		*lastErr = nil
-		return recursiveHopCerts(decodedCerts[0], chain, lastErr, timeOut)
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
 	}
 
-	return nil
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	return certs[0].Verify(x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates, Roots: roots})
 }
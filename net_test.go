@@ -1,7 +1,12 @@
 package certmin
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"crypto/x509"
+	"io"
+	"net"
 	"os"
 	"testing"
 	"time"
@@ -9,6 +14,82 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// startTestServer starts a local TLS server offering t/myserver.crt. The plain
+// text dialogue, if not nil, is run before the TLS handshake. It returns the
+// address of the server.
+func startTestServer(t *testing.T, dialogue func(net.Conn, *bufio.Reader)) string {
+	return startTestServerWithConfig(t, dialogue, &tls.Config{})
+}
+
+// startTestServerWithConfig starts a local TLS server like startTestServer with the
+// given configuration.
+func startTestServerWithConfig(t *testing.T, dialogue func(net.Conn, *bufio.Reader), config *tls.Config) string {
+	cert, err := tls.LoadX509KeyPair("t/myserver.crt", "t/myserver.key")
+	assert.NoError(t, err)
+	if len(config.Certificates) == 0 {
+		config.Certificates = []tls.Certificate{cert}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buffered := bufferedConn{conn, bufio.NewReader(conn)}
+				if dialogue != nil {
+					dialogue(conn, buffered.reader)
+				}
+				server := tls.Server(buffered, config)
+				if server.Handshake() == nil {
+					server.Read(make([]byte, 1)) // wait for the client to close
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// startSNITestServer starts a local TLS server offering t/myserver.crt that
+// sends the received SNI to the channel. It returns the port of the server.
+func startSNITestServer(t *testing.T, sni chan string) string {
+	cert, err := tls.LoadX509KeyPair("t/myserver.crt", "t/myserver.key")
+	assert.NoError(t, err)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni <- hello.ServerName
+			return nil, nil
+		},
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	assert.NoError(t, err)
+	return port
+}
+
 func TestRetrieveCertsFromAddr(t *testing.T) {
 	certs, warn, err := RetrieveCertsFromAddr("faa", 1*time.Second)
 	assert.Nil(t, certs)
@@ -33,6 +114,87 @@ func TestRetrieveCertsFromAddr(t *testing.T) {
 	}
 }
 
+func TestRetrieveCerts_StartTLS(t *testing.T) {
+	addr := startTestServer(t, nil)
+	result, err := RetrieveCerts(addr, nil)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(result.PeerCertificates)) {
+		assert.Error(t, result.Warning()) // self-signed CA
+		assert.Equal(t, "myserver", result.PeerCertificates[0].Subject.CommonName)
+	}
+
+	addr = startTestServer(t, testSMTPDialogue)
+	result, err = RetrieveCerts(addr, &RetrieveOptions{Timeout: 5 * time.Second, StartTLS: StartTLSSMTP})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(result.PeerCertificates)) {
+		assert.Equal(t, "myserver", result.PeerCertificates[0].Subject.CommonName)
+	}
+
+	result, err = RetrieveCerts(addr, &RetrieveOptions{Timeout: 5 * time.Second})
+	assert.Error(t, err)
+	assert.Nil(t, result)
+
+	addr = startTestServer(t, func(conn net.Conn, r *bufio.Reader) {
+		io.ReadFull(r, make([]byte, 8))
+		conn.Write([]byte("S"))
+	})
+	result, err = RetrieveCerts(addr, &RetrieveOptions{StartTLS: StartTLSPostgres})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, len(result.PeerCertificates))
+	}
+
+	addr = startTestServer(t, func(conn net.Conn, r *bufio.Reader) {
+		conn.Write(testMySQLHandshake(0xffff))
+		io.ReadFull(r, make([]byte, 36))
+	})
+	result, err = RetrieveCerts(addr, &RetrieveOptions{StartTLS: StartTLSMySQL})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, len(result.PeerCertificates))
+	}
+}
+
+func TestRetrieveCerts_SNI(t *testing.T) {
+	sni := make(chan string, 2)
+	port := startSNITestServer(t, sni)
+	addr := "myserver:" + port
+
+	result, err := RetrieveCerts(addr, &RetrieveOptions{ConnectTo: "127.0.0.1"})
+	if assert.NoError(t, err) {
+		assert.Error(t, result.Warning())
+		assert.Equal(t, 1, len(result.PeerCertificates))
+	}
+	assert.Equal(t, "myserver", <-sni)
+
+	_, err = RetrieveCerts(addr, &RetrieveOptions{ConnectTo: "127.0.0.1", ServerName: "foo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", <-sni)
+
+	_, err = RetrieveCerts("127.0.0.1:"+port, nil) // no SNI for IP addresses
+	assert.NoError(t, err)
+	assert.Equal(t, "", <-sni)
+
+	result, err = RetrieveCerts("localhost:"+port, &RetrieveOptions{NoSNI: true})
+	if assert.NoError(t, err) {
+		assert.Error(t, result.Warning())
+		assert.Equal(t, 1, len(result.PeerCertificates))
+	}
+	assert.Equal(t, "", <-sni)
+	assert.Equal(t, 0, len(sni)) // a single handshake each
+}
+
+func TestRetrieveCerts_Proxy(t *testing.T) {
+	addr := startTestServer(t, testSMTPDialogue)
+	for _, proxyStr := range []string{
+		"http://" + startTestProxy(t, false, nil), "socks5://" + startTestProxy(t, true, nil),
+	} {
+		result, err := RetrieveCerts(addr,
+			&RetrieveOptions{Timeout: 5 * time.Second, StartTLS: StartTLSSMTP, Proxy: proxyStr})
+		if assert.NoError(t, err) {
+			assert.Equal(t, 1, len(result.PeerCertificates))
+		}
+	}
+}
+
 func TestRetrieveChainFromIssuerURLs(t *testing.T) {
 	certs, err := DecodeCertFile("t/myserver.crt", "")
 	assert.NoError(t, err)
@@ -40,6 +202,9 @@ func TestRetrieveChainFromIssuerURLs(t *testing.T) {
 	chain, err := RetrieveChainFromIssuerURLs(certs[0], 1*time.Second)
 	assert.NoError(t, err)
 	assert.Equal(t, []*x509.Certificate{certs[0]}, chain)
+	chain, err = NewClient().RetrieveChainFromIssuerURLs(context.Background(), certs[0], nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{certs[0]}, chain)
 
 	if os.Getenv("AUTHOR_TESTING") != "" {
 		certs, err := DecodeCertFile("t/kuleuven-be.pem", "")
@@ -50,25 +215,62 @@ func TestRetrieveChainFromIssuerURLs(t *testing.T) {
 	}
 }
 
-func TestConnectAndRetrieve(t *testing.T) {
+func TestClient_handshake(t *testing.T) {
 	if os.Getenv("AUTHOR_TESTING") != "" {
-		if os.Getenv("AUTHOR_TESTING") != "" {
-			certs, err := connectAndRetrieve("github.com:443", 5*time.Second, false)
-			assert.NoError(t, err)
-			assert.True(t, len(certs) >= 2)
-		}
+		result, err := NewClient(WithTimeout(5*time.Second)).handshake(context.Background(), "github.com:443", nil, nil)
+		assert.NoError(t, err)
+		assert.True(t, len(result.PeerCertificates) >= 2)
+		assert.True(t, result.Verified())
 	}
-}
 
-func TestRecursiveHopCerts(t *testing.T) {
-	if os.Getenv("AUTHOR_TESTING") != "" {
-		certs, err := DecodeCertFile("t/kuleuven-be.pem", "")
-		assert.NoError(t, err)
-		var chain []*x509.Certificate
-		var lastErr error
-		recursiveHopCerts(certs[0], &chain, &lastErr, 5*time.Second)
-		leftOver := recursiveHopCerts(certs[0], &chain, &lastErr, 5*time.Second)
-		assert.Nil(t, leftOver)
-		assert.True(t, len(chain) >= 2)
+	addr := startTestServer(t, nil)
+	result, err := NewClient(WithTimeout(5*time.Second)).handshake(context.Background(), addr, &RetrieveOptions{}, nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		assert.Equal(t, addr, result.RemoteAddr)
+		assert.Equal(t, 1, len(result.PeerCertificates))
+		assert.NotNil(t, result.Handshake)
+		assert.True(t, result.HandshakeTime > 0)
 	}
 }
+
+func TestConnectToAddr(t *testing.T) {
+	addr, err := connectToAddr("foo:443", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo:443", addr)
+
+	addr, err = connectToAddr("foo:443", "10.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:443", addr)
+
+	addr, err = connectToAddr("foo:443", "10.0.0.1:8443")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:8443", addr)
+
+	addr, err = connectToAddr("foo:443", "[::1]")
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:443", addr)
+
+	_, err = connectToAddr("foo", "10.0.0.1")
+	assert.Error(t, err)
+}
+
+func TestVerifyPeerCerts(t *testing.T) {
+	certs, err := DecodeCertFile("t/myserver.crt", "")
+	assert.NoError(t, err)
+	_, err = verifyPeerCerts([][]byte{certs[0].Raw}, "myserver", nil)
+	assert.Error(t, err) // untrusted
+	_, err = verifyPeerCerts([][]byte{[]byte("foo")}, "myserver", nil)
+	assert.Error(t, err)
+	_, err = verifyPeerCerts(nil, "myserver", nil)
+	assert.Error(t, err)
+
+	cert := testSelfSignedCert(t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	chains, err := verifyPeerCerts(cert.Certificate, "myserver", pool)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(chains))
+}
@@ -0,0 +1,188 @@
+package certmin
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ProxyDirect disables the proxy from the environment when used as the Proxy field
+// of RetrieveOptions.
+const ProxyDirect = "direct"
+
+// proxyPorts are the default ports of the supported proxy schemes.
+var proxyPorts = map[string]string{
+	"http":    "8080",
+	"socks5":  "1080",
+	"socks5h": "1080",
+}
+
+// dialFunc opens a network connection
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// bufferedConn reads through the buffer used to read the proxy response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// Dial makes dialFunc a proxy.Dialer
+func (dial dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return dial(context.Background(), network, addr)
+}
+
+// DialContext makes dialFunc a proxy.ContextDialer
+func (dial dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dial(ctx, network, addr)
+}
+
+// dialAddr connects to addr directly or through the proxy for addr
+func dialAddr(ctx context.Context, addr, proxyStr string, dial dialFunc) (net.Conn, error) {
+	proxyURL, err := proxyForURL(proxyStr, &url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return dial(ctx, "tcp", addr)
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), proxyPorts[proxyURL.Scheme])
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		socksDialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, dial)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := socksDialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("proxy %s: %s", proxyAddr, err)
+		}
+		return conn, nil
+	default:
+		return dialHTTPConnect(ctx, proxyURL, proxyAddr, addr, dial)
+	}
+}
+
+// dialHTTPConnect opens a tunnel to addr through a HTTP proxy
+func dialHTTPConnect(ctx context.Context, proxyURL *url.URL, proxyAddr, addr string, dial dialFunc) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %s", proxyAddr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", proxyAddr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", proxyAddr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 { // e.g. the greeting of a STARTTLS server
+		return bufferedConn{conn, reader}, nil
+	}
+	return conn, nil
+}
+
+// getenvAny returns the value of the first set environment variable
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseProxy parses a proxy URL, with http as the default scheme
+func parseProxy(proxyStr string) (*url.URL, error) {
+	if !strings.Contains(proxyStr, "://") {
+		proxyStr = "http://" + proxyStr
+	}
+	proxyURL, err := url.Parse(proxyStr)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := proxyPorts[proxyURL.Scheme]; !ok {
+		return nil, fmt.Errorf("unsupported proxy scheme (%s)", proxyURL.Scheme)
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, errors.New("no proxy hostname found")
+	}
+	return proxyURL, nil
+}
+
+// proxyForURL returns the proxy to use for the target URL: the given proxy or,
+// if empty, the proxy from the HTTPS_PROXY, HTTP_PROXY, ALL_PROXY and NO_PROXY
+// environment variables (and their lowercase versions). It returns nil for a
+// direct connection.
+func proxyForURL(proxyStr string, target *url.URL) (*url.URL, error) {
+	switch proxyStr {
+	case ProxyDirect:
+		return nil, nil
+	case "":
+		config := httpproxy.FromEnvironment()
+		allProxy := getenvAny("ALL_PROXY", "all_proxy")
+		if config.HTTPProxy == "" {
+			config.HTTPProxy = allProxy
+		}
+		if config.HTTPSProxy == "" {
+			config.HTTPSProxy = allProxy
+		}
+		proxyURL, err := config.ProxyFunc()(target)
+		if err != nil || proxyURL == nil {
+			return nil, err
+		}
+		return parseProxy(proxyURL.String())
+	default:
+		return parseProxy(proxyStr)
+	}
+}
@@ -0,0 +1,114 @@
+package certmin
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+)
+
+// VerifyErrorKind classifies the reason why the certificates of a server could not
+// be verified.
+type VerifyErrorKind int
+
+const (
+	// VerifyErrorInvalid is used for reasons not covered by the other kinds, e.g. an
+	// unauthorized key usage or a malformed certificate.
+	VerifyErrorInvalid VerifyErrorKind = iota
+	// VerifyErrorUnknownAuthority is used if no chain to a trusted root was found.
+	VerifyErrorUnknownAuthority
+	// VerifyErrorHostnameMismatch is used if the certificate is not valid for the
+	// server name.
+	VerifyErrorHostnameMismatch
+	// VerifyErrorExpired is used if a certificate of the chain is expired or not
+	// yet valid.
+	VerifyErrorExpired
+)
+
+// verifyErrorKindNames maps the kinds of verification errors to their names.
+var verifyErrorKindNames = map[VerifyErrorKind]string{
+	VerifyErrorInvalid:          "invalid certificate",
+	VerifyErrorUnknownAuthority: "unknown authority",
+	VerifyErrorHostnameMismatch: "hostname mismatch",
+	VerifyErrorExpired:          "expired certificate",
+}
+
+// VerificationError represents the failed verification of the certificates of a
+// server. Err is the error returned by crypto/x509.
+type VerificationError struct {
+	Kind VerifyErrorKind
+	Err  error
+}
+
+// RetrievalResult represents the outcome of retrieving the certificates of a remote
+// host. PeerCertificates are the certificates offered by the server (with the first
+// element being the certificate of the server) and VerifiedChains the chains to a
+// trusted root if the verification succeeded, with VerifyError describing the failure
+// otherwise. RemoteAddr is the address of the TCP connection (the proxy when
+// connecting through one), DialTime the time spent opening it and HandshakeTime the
+// time spent in the StartTLS negotiation and the TLS handshake. Handshake holds the
+// details of the TLS handshake.
+type RetrievalResult struct {
+	PeerCertificates []*x509.Certificate
+	VerifiedChains   [][]*x509.Certificate
+	VerifyError      *VerificationError
+	RemoteAddr       string
+	DialTime         time.Duration
+	HandshakeTime    time.Duration
+	Handshake        *HandshakeInfo
+}
+
+// RetrieveCerts retrieves all the certificates offered by the remote host and
+// verifies them in a single handshake. As parameters it takes an address string
+// like RetrieveCertsFromAddr and a *RetrieveOptions (nil for the defaults). The
+// return values are a *RetrievalResult and an error in case of failure. A failed
+// verification is not an error but is set in the VerifyError field of the result.
+func RetrieveCerts(addr string, options *RetrieveOptions) (*RetrievalResult, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+	return clientForOptions(options).RetrieveCerts(context.Background(), addr, options)
+}
+
+// Error returns the message of the crypto/x509 error.
+func (err *VerificationError) Error() string {
+	return err.Err.Error()
+}
+
+// Unwrap returns the crypto/x509 error.
+func (err *VerificationError) Unwrap() error {
+	return err.Err
+}
+
+// String returns the name of the kind of verification error.
+func (kind VerifyErrorKind) String() string {
+	return verifyErrorKindNames[kind]
+}
+
+// Verified returns true if the certificates of the server were verified.
+func (result *RetrievalResult) Verified() bool {
+	return result.VerifyError == nil
+}
+
+// Warning returns the verification error as an error, nil if verified.
+func (result *RetrievalResult) Warning() error {
+	if result.VerifyError == nil {
+		return nil
+	}
+	return result.VerifyError
+}
+
+// newVerificationError classifies an error returned by crypto/x509
+func newVerificationError(err error) *VerificationError {
+	kind := VerifyErrorInvalid
+	switch typedErr := err.(type) {
+	case x509.UnknownAuthorityError, x509.SystemRootsError:
+		kind = VerifyErrorUnknownAuthority
+	case x509.HostnameError:
+		kind = VerifyErrorHostnameMismatch
+	case x509.CertificateInvalidError:
+		if typedErr.Reason == x509.Expired {
+			kind = VerifyErrorExpired
+		}
+	}
+	return &VerificationError{Kind: kind, Err: err}
+}
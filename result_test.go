@@ -0,0 +1,75 @@
+package certmin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrieveCerts(t *testing.T) {
+	sni := make(chan string, 2)
+	port := startSNITestServer(t, sni)
+
+	result, err := RetrieveCerts("myserver:"+port, &RetrieveOptions{ConnectTo: "127.0.0.1", Timeout: 5 * time.Second})
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		assert.Equal(t, 1, len(result.PeerCertificates))
+		assert.False(t, result.Verified())
+		assert.Nil(t, result.VerifiedChains)
+		assert.Equal(t, VerifyErrorExpired, result.VerifyError.Kind) // t/myserver.crt
+		assert.Error(t, result.Warning())
+		assert.Equal(t, "127.0.0.1:"+port, result.RemoteAddr)
+		assert.Equal(t, "TLS 1.3", result.Handshake.VersionName())
+	}
+	assert.Equal(t, "myserver", <-sni)
+	assert.Equal(t, 0, len(sni))
+
+	cert := testSelfSignedCert(t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	addr := startTestServerWithConfig(t, nil, &tls.Config{Certificates: []tls.Certificate{cert}})
+	client := NewClient(WithRootCAs(pool), WithTimeout(5*time.Second))
+	result, err = client.handshake(context.Background(), addr, &RetrieveOptions{ServerName: "myserver"}, nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		assert.True(t, result.Verified())
+		assert.Nil(t, result.Warning())
+		assert.Equal(t, 1, len(result.VerifiedChains))
+	}
+
+	result, err = client.handshake(context.Background(), addr, &RetrieveOptions{ServerName: "other"}, nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, result) {
+		assert.Equal(t, VerifyErrorHostnameMismatch, result.VerifyError.Kind)
+	}
+
+	_, err = RetrieveCerts("127.0.0.1:1", nil)
+	assert.Error(t, err)
+}
+
+func TestVerifyErrorKind_String(t *testing.T) {
+	assert.Equal(t, "unknown authority", VerifyErrorUnknownAuthority.String())
+	assert.Equal(t, "hostname mismatch", VerifyErrorHostnameMismatch.String())
+}
+
+func TestNewVerificationError(t *testing.T) {
+	assert.Equal(t, VerifyErrorUnknownAuthority, newVerificationError(x509.UnknownAuthorityError{}).Kind)
+	assert.Equal(t, VerifyErrorHostnameMismatch, newVerificationError(x509.HostnameError{}).Kind)
+	assert.Equal(t, VerifyErrorExpired,
+		newVerificationError(x509.CertificateInvalidError{Reason: x509.Expired}).Kind)
+	assert.Equal(t, VerifyErrorInvalid,
+		newVerificationError(x509.CertificateInvalidError{Reason: x509.TooManyIntermediates}).Kind)
+
+	err := newVerificationError(errors.New("foo"))
+	assert.Equal(t, VerifyErrorInvalid, err.Kind)
+	assert.Equal(t, "foo", err.Error())
+	var verifyErr *VerificationError
+	assert.True(t, errors.As(error(err), &verifyErr))
+}
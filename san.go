@@ -0,0 +1,178 @@
+package certmin
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+var oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// otherNameNames maps the OIDs of well-known otherName types to their names.
+var otherNameNames = map[string]string{
+	"1.3.6.1.4.1.311.20.2.3": "Microsoft UPN",
+	"1.3.6.1.4.1.311.25.1":   "Microsoft NTDS Replication",
+	"1.3.6.1.5.2.2":          "Kerberos Principal Name",
+	"1.3.6.1.5.5.7.8.4":      "Permanent Identifier",
+	"1.3.6.1.5.5.7.8.5":      "XMPP Address",
+	"1.3.6.1.5.5.7.8.7":      "DNS SRV Name",
+	"1.3.6.1.5.5.7.8.9":      "SMTP UTF8 Mailbox",
+}
+
+// generalNameTypes lists the names of the GeneralName types by their tag.
+var generalNameTypes = []string{
+	"otherName",
+	"email",
+	"DNS",
+	"x400Address",
+	"directoryName",
+	"ediPartyName",
+	"URI",
+	"IP",
+	"registeredID",
+}
+
+// GeneralName represents an entry of the Subject Alternative Name extension. Type
+// is one of otherName, email, DNS, x400Address, directoryName, ediPartyName, URI,
+// IP or registeredID. For otherName entries OID holds the type-id and Name its
+// name if well-known. Values that can not be decoded are given in hex. Unicode
+// is set for DNS names with punycode (IDN) labels.
+type GeneralName struct {
+	Type    string
+	OID     string
+	Name    string
+	Value   string
+	Unicode string
+}
+
+// ParseSubjectAltNames returns all the entries of the Subject Alternative Name
+// extension of a certificate, including the types not supported by crypto/x509,
+// as a []GeneralName and an error if encountered.
+func ParseSubjectAltNames(cert *x509.Certificate) ([]GeneralName, error) {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidExtensionSubjectAltName) {
+			return parseGeneralNames(ext.Value)
+		}
+	}
+	return nil, nil
+}
+
+// decodeOtherName decodes the value of well-known otherName types
+func decodeOtherName(oid string, value []byte) string {
+	switch oid {
+	case "1.3.6.1.5.2.2":
+		var principal struct {
+			Realm         asn1.RawValue `asn1:"explicit,tag:0"`
+			PrincipalName struct {
+				NameType   int             `asn1:"explicit,tag:0"`
+				NameString []asn1.RawValue `asn1:"explicit,tag:1"`
+			} `asn1:"explicit,tag:1"`
+		}
+		var realm asn1.RawValue
+		if _, err := asn1.Unmarshal(value, &principal); err == nil {
+			if _, err := asn1.Unmarshal(principal.Realm.Bytes, &realm); err == nil {
+				var names []string
+				for _, name := range principal.PrincipalName.NameString {
+					names = append(names, string(name.Bytes))
+				}
+				return strings.Join(names, "/") + "@" + string(realm.Bytes)
+			}
+		}
+	default:
+		var inner asn1.RawValue
+		if _, err := asn1.Unmarshal(value, &inner); err == nil && inner.Class == asn1.ClassUniversal {
+			switch inner.Tag {
+			case asn1.TagUTF8String, asn1.TagPrintableString, asn1.TagIA5String, 26: // VisibleString
+				return string(inner.Bytes)
+			case 30: // BMPString
+				return decodeDisplayText(inner)
+			case asn1.TagOctetString:
+				return hex.EncodeToString(inner.Bytes)
+			}
+		}
+	}
+
+	return hex.EncodeToString(value)
+}
+
+// parseGeneralNames decodes a GeneralNames sequence
+func parseGeneralNames(value []byte) ([]GeneralName, error) {
+	var seq asn1.RawValue
+	rest, err := asn1.Unmarshal(value, &seq)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 || !seq.IsCompound || seq.Tag != asn1.TagSequence || seq.Class != asn1.ClassUniversal {
+		return nil, errors.New("invalid subject alternative name extension")
+	}
+
+	var names []GeneralName
+	rest = seq.Bytes
+	for len(rest) > 0 {
+		var raw asn1.RawValue
+		rest, err = asn1.Unmarshal(rest, &raw)
+		if err != nil {
+			return nil, err
+		}
+		if raw.Class != asn1.ClassContextSpecific || raw.Tag >= len(generalNameTypes) {
+			return nil, errors.New("invalid general name")
+		}
+
+		name := GeneralName{Type: generalNameTypes[raw.Tag]}
+		switch raw.Tag {
+		case 0: // otherName
+			var oid asn1.ObjectIdentifier
+			otherRest, err := asn1.Unmarshal(raw.Bytes, &oid)
+			if err != nil {
+				return nil, err
+			}
+			var wrapped asn1.RawValue
+			if _, err := asn1.Unmarshal(otherRest, &wrapped); err != nil {
+				return nil, err
+			}
+			name.OID = oid.String()
+			name.Name = otherNameNames[name.OID]
+			name.Value = decodeOtherName(name.OID, wrapped.Bytes)
+		case 1, 6: // email, URI
+			name.Value = string(raw.Bytes)
+		case 2: // DNS
+			name.Value = string(raw.Bytes)
+			if strings.Contains(strings.ToLower(name.Value), "xn--") {
+				if unicode, err := idna.ToUnicode(name.Value); err == nil && unicode != name.Value {
+					name.Unicode = unicode
+				}
+			}
+		case 4: // directoryName
+			var rdn pkix.RDNSequence
+			if _, err := asn1.Unmarshal(raw.Bytes, &rdn); err != nil {
+				return nil, err
+			}
+			var dirName pkix.Name
+			dirName.FillFromRDNSequence(&rdn)
+			name.Value = dirName.String()
+		case 7: // IP
+			name.Value = net.IP(raw.Bytes).String()
+		case 8: // registeredID
+			var oid asn1.ObjectIdentifier
+			fullBytes, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagOID, Bytes: raw.Bytes})
+			if err != nil {
+				return nil, err
+			}
+			if _, err := asn1.Unmarshal(fullBytes, &oid); err != nil {
+				return nil, err
+			}
+			name.Value = oid.String()
+		default: // x400Address, ediPartyName
+			name.Value = hex.EncodeToString(raw.Bytes)
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
@@ -0,0 +1,70 @@
+package certmin
+
+import (
+	"encoding/asn1"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSubjectAltNames(t *testing.T) {
+	certs, err := DecodeCertFile("t/san-othername.crt", "")
+	assert.NoError(t, err)
+	names, err := ParseSubjectAltNames(certs[0])
+	assert.NoError(t, err)
+	if assert.Equal(t, 11, len(names)) {
+		assert.Equal(t, GeneralName{Type: "DNS", Value: "xn--bcher-kva.example", Unicode: "bücher.example"}, names[0])
+		assert.Equal(t, GeneralName{Type: "DNS", Value: "www.example.com"}, names[1])
+		assert.Equal(t, GeneralName{Type: "email", Value: "user@example.com"}, names[2])
+		assert.Equal(t, GeneralName{Type: "otherName", OID: "1.3.6.1.4.1.311.20.2.3", Name: "Microsoft UPN",
+			Value: "user@corp.example.com"}, names[3])
+		assert.Equal(t, "user@xmpp.example.com", names[4].Value)
+		assert.Equal(t, "_xmpp-client.example.com", names[5].Value)
+		assert.Equal(t, GeneralName{Type: "otherName", OID: "1.2.3.4", Value: "4445414442454546"}, names[6])
+		assert.Equal(t, GeneralName{Type: "directoryName", Value: "CN=Directory Name,O=Example,C=BE"}, names[7])
+		assert.Equal(t, GeneralName{Type: "registeredID", Value: "1.2.3.4.5"}, names[8])
+		assert.Equal(t, GeneralName{Type: "IP", Value: "192.0.2.1"}, names[9])
+		assert.Equal(t, GeneralName{Type: "URI", Value: "https://example.com/"}, names[10])
+	}
+
+	certs, err = DecodeCertFile("t/ca.crt", "")
+	assert.NoError(t, err)
+	names, err = ParseSubjectAltNames(certs[0])
+	assert.NoError(t, err)
+	assert.Nil(t, names)
+}
+
+func TestDecodeOtherName(t *testing.T) {
+	explicit := func(tag int, value interface{}) asn1.RawValue {
+		fullBytes, _ := asn1.Marshal(value)
+		return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: fullBytes}
+	}
+	nameStrings := []asn1.RawValue{{Tag: 27, Bytes: []byte("host")}, {Tag: 27, Bytes: []byte("foo.example.com")}}
+	principalName := []asn1.RawValue{explicit(0, 1), explicit(1, nameStrings)}
+	value, err := asn1.Marshal([]asn1.RawValue{
+		explicit(0, asn1.RawValue{Tag: 27, Bytes: []byte("EXAMPLE.COM")}),
+		explicit(1, principalName),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "host/foo.example.com@EXAMPLE.COM", decodeOtherName("1.3.6.1.5.2.2", value))
+
+	value, _ = asn1.Marshal(asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte("foo")})
+	assert.Equal(t, "foo", decodeOtherName("1.3.6.1.4.1.311.20.2.3", value))
+
+	value, _ = asn1.Marshal(42)
+	assert.Equal(t, "02012a", decodeOtherName("1.2.3", value))
+}
+
+func TestParseGeneralNames(t *testing.T) {
+	_, err := parseGeneralNames([]byte("foo"))
+	assert.Error(t, err)
+
+	value, _ := asn1.Marshal([]asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 9, Bytes: []byte("foo")}})
+	_, err = parseGeneralNames(value)
+	assert.Error(t, err)
+
+	value, _ = asn1.Marshal([]asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 3, Bytes: []byte{1, 2}}})
+	names, err := parseGeneralNames(value)
+	assert.NoError(t, err)
+	assert.Equal(t, []GeneralName{{Type: "x400Address", Value: "0102"}}, names)
+}
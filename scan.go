@@ -0,0 +1,187 @@
+package certmin
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+)
+
+// DefaultScanWorkers is the number of concurrent handshakes used by ScanTLS if
+// not given.
+const DefaultScanWorkers = 4
+
+// scanVersions are the protocol versions scanned by ScanTLS.
+var scanVersions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// TLSVersionScan represents the result of scanning a protocol version. CipherSuites
+// lists the accepted cipher suites in the server's preference order (or in the
+// client's order for servers that follow the client's preference). As crypto/tls
+// does not allow to restrict the TLS 1.3 cipher suites, only the negotiated suite
+// is listed for TLS 1.3.
+type TLSVersionScan struct {
+	Version      uint16
+	Accepted     bool
+	CipherSuites []uint16
+}
+
+// ScanTLS performs repeated handshakes with the remote host constrained to each
+// protocol version and cipher suite supported by crypto/tls. As parameters it takes
+// an address string like RetrieveCertsFromAddr, a *RetrieveOptions (nil for the
+// defaults) used for every connection and the maximum number of concurrent
+// handshakes (DefaultScanWorkers if smaller than 1). The return values are a
+// []TLSVersionScan ordered from the oldest to the newest version and an error if
+// no version was accepted.
+func ScanTLS(addr string, options *RetrieveOptions, workers int) ([]TLSVersionScan, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+	return clientForOptions(options).ScanTLS(context.Background(), addr, options, workers)
+}
+
+// CipherSuiteNames returns the names of the accepted cipher suites.
+func (scan *TLSVersionScan) CipherSuiteNames() []string {
+	var names []string
+	for _, suite := range scan.CipherSuites {
+		names = append(names, tls.CipherSuiteName(suite))
+	}
+	return names
+}
+
+// VersionName returns the name of the scanned protocol version.
+func (scan *TLSVersionScan) VersionName() string {
+	return versionName(scan.Version)
+}
+
+// ScanTLS scans the protocol versions and cipher suites accepted by the remote
+// host like the ScanTLS function, with a context.Context to cancel the scan.
+func (client *Client) ScanTLS(
+	ctx context.Context, addr string, options *RetrieveOptions, workers int) ([]TLSVersionScan, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+	if workers < 1 {
+		workers = DefaultScanWorkers
+	}
+
+	scanner := tlsScanner{
+		ctx: ctx, client: client, addr: addr, options: options, workers: make(chan struct{}, workers)}
+	results := make([]TLSVersionScan, len(scanVersions))
+	var wg sync.WaitGroup
+	for idx, version := range scanVersions {
+		wg.Add(1)
+		go func(idx int, version uint16) {
+			defer wg.Done()
+			results[idx] = scanner.scanVersion(version)
+		}(idx, version)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
+
+	for _, result := range results {
+		if result.Accepted {
+			return results, nil
+		}
+	}
+	if scanner.lastErr != nil {
+		return results, scanner.lastErr
+	}
+	return results, errors.New("no protocol version accepted")
+}
+
+// tlsScanner limits the concurrent handshakes of a scan
+type tlsScanner struct {
+	ctx     context.Context
+	client  *Client
+	addr    string
+	options *RetrieveOptions
+	workers chan struct{}
+	mutex   sync.Mutex
+	lastErr error
+}
+
+// scanVersion finds the accepted cipher suites of a protocol version and
+// orders them by the server's preference
+func (scanner *tlsScanner) scanVersion(version uint16) TLSVersionScan {
+	result := TLSVersionScan{Version: version}
+	if version == tls.VersionTLS13 {
+		if suite, ok := scanner.try(version, nil); ok {
+			result.Accepted = true
+			result.CipherSuites = []uint16{suite}
+		}
+		return result
+	}
+
+	var candidates []uint16
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		for _, supported := range suite.SupportedVersions {
+			if supported == version {
+				candidates = append(candidates, suite.ID)
+			}
+		}
+	}
+
+	accepted := make([]bool, len(candidates))
+	var wg sync.WaitGroup
+	for idx, suite := range candidates {
+		wg.Add(1)
+		go func(idx int, suite uint16) {
+			defer wg.Done()
+			_, accepted[idx] = scanner.try(version, []uint16{suite})
+		}(idx, suite)
+	}
+	wg.Wait()
+
+	var remaining []uint16
+	for idx, suite := range candidates {
+		if accepted[idx] {
+			remaining = append(remaining, suite)
+		}
+	}
+	result.Accepted = len(remaining) > 0
+
+	// The server picks its preferred suite among the remaining ones
+	for len(remaining) > 0 {
+		suite, ok := scanner.try(version, remaining)
+		if !ok {
+			result.CipherSuites = append(result.CipherSuites, remaining...)
+			break
+		}
+		result.CipherSuites = append(result.CipherSuites, suite)
+		var others []uint16
+		for _, remainingSuite := range remaining {
+			if remainingSuite != suite {
+				others = append(others, remainingSuite)
+			}
+		}
+		if len(others) == len(remaining) { // not one of the offered suites
+			break
+		}
+		remaining = others
+	}
+
+	return result
+}
+
+// try returns the cipher suite negotiated in a handshake constrained to a
+// protocol version and cipher suites and whether the handshake succeeded
+func (scanner *tlsScanner) try(version uint16, suites []uint16) (uint16, bool) {
+	scanner.workers <- struct{}{}
+	defer func() { <-scanner.workers }()
+
+	configure := func(config *tls.Config) {
+		config.MinVersion = version
+		config.MaxVersion = version
+		config.CipherSuites = suites
+	}
+	result, err := scanner.client.handshake(scanner.ctx, scanner.addr, scanner.options, configure)
+	if err != nil {
+		scanner.mutex.Lock()
+		scanner.lastErr = err
+		scanner.mutex.Unlock()
+		return 0, false
+	}
+	return result.Handshake.CipherSuite, true
+}
@@ -0,0 +1,81 @@
+package certmin
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_ScanTLS(t *testing.T) {
+	addr := startTestServerWithConfig(t, nil, &tls.Config{MinVersion: tls.VersionTLS13})
+	var dials int32
+	dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	client := NewClient(WithDialContext(dial), WithTimeout(5*time.Second))
+	results, err := client.ScanTLS(context.Background(), "myserver:443", &RetrieveOptions{Proxy: ProxyDirect}, 0)
+	assert.NoError(t, err)
+	if assert.Equal(t, 4, len(results)) {
+		assert.True(t, results[3].Accepted)
+	}
+	assert.True(t, atomic.LoadInt32(&dials) > 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.ScanTLS(ctx, "myserver:443", &RetrieveOptions{Proxy: ProxyDirect}, 0)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestScanTLS(t *testing.T) {
+	suites := []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	}
+	addr := startTestServerWithConfig(t, nil, &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: suites,
+	})
+	results, err := ScanTLS(addr, &RetrieveOptions{Timeout: 5 * time.Second}, 2)
+	assert.NoError(t, err)
+	if assert.Equal(t, 4, len(results)) {
+		assert.Equal(t, "TLS 1.0", results[0].VersionName())
+		assert.False(t, results[0].Accepted)
+		assert.False(t, results[1].Accepted)
+		assert.True(t, results[2].Accepted)
+		assert.ElementsMatch(t, suites, results[2].CipherSuites)
+		assert.False(t, results[3].Accepted)
+	}
+
+	addr = startTestServerWithConfig(t, nil, &tls.Config{
+		MinVersion:   tls.VersionTLS10,
+		MaxVersion:   tls.VersionTLS11,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+	})
+	results, err = ScanTLS(addr, nil, 0)
+	assert.NoError(t, err)
+	if assert.Equal(t, 4, len(results)) {
+		assert.True(t, results[0].Accepted)
+		assert.Equal(t, []string{"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"}, results[1].CipherSuiteNames())
+		assert.False(t, results[2].Accepted)
+	}
+
+	addr = startTestServerWithConfig(t, nil, &tls.Config{MinVersion: tls.VersionTLS13})
+	results, err = ScanTLS(addr, nil, 0)
+	assert.NoError(t, err)
+	if assert.Equal(t, 4, len(results)) {
+		assert.False(t, results[2].Accepted)
+		assert.True(t, results[3].Accepted)
+		assert.Equal(t, 1, len(results[3].CipherSuiteNames()))
+	}
+
+	_, err = ScanTLS("127.0.0.1:1", nil, 0)
+	assert.Error(t, err)
+}
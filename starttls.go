@@ -0,0 +1,374 @@
+package certmin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// Protocols supported by the StartTLS field of RetrieveOptions. The connection
+// starts in plain text and is upgraded to TLS with the protocol's own dialogue.
+const (
+	StartTLSFTP        = "ftp"
+	StartTLSIMAP       = "imap"
+	StartTLSLDAP       = "ldap"
+	StartTLSMySQL      = "mysql"
+	StartTLSPOP3       = "pop3"
+	StartTLSPostgres   = "postgres"
+	StartTLSSMTP       = "smtp"
+	StartTLSXMPP       = "xmpp"
+	StartTLSXMPPServer = "xmpp-server"
+)
+
+// ldapStartTLSOID is the name of the LDAP StartTLS extended operation (RFC 4511)
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// XMPP namespaces used in the STARTTLS negotiation (RFC 6120)
+const (
+	xmppNSClient = "jabber:client"
+	xmppNSServer = "jabber:server"
+	xmppNSStream = "http://etherx.jabber.org/streams"
+	xmppNSTLS    = "urn:ietf:params:xml:ns:xmpp-tls"
+)
+
+// MySQL capability flags used in the SSL upgrade
+const (
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSSL              = 0x00000800
+	mysqlClientSecureConnection = 0x00008000
+)
+
+// startTLSFuncs maps the supported protocols to their upgrade dialogue.
+var startTLSFuncs = map[string]func(net.Conn, string) error{
+	StartTLSFTP:        startTLSFTP,
+	StartTLSIMAP:       startTLSIMAP,
+	StartTLSLDAP:       startTLSLDAP,
+	StartTLSMySQL:      startTLSMySQL,
+	StartTLSPOP3:       startTLSPOP3,
+	StartTLSPostgres:   startTLSPostgres,
+	StartTLSSMTP:       startTLSSMTP,
+	StartTLSXMPP:       startTLSXMPPClient,
+	StartTLSXMPPServer: startTLSXMPPServer,
+}
+
+// startTLSSchemes maps URL schemes to the protocol used to upgrade the connection.
+var startTLSSchemes = map[string]string{
+	"ftp":         StartTLSFTP,
+	"imap":        StartTLSIMAP,
+	"ldap":        StartTLSLDAP,
+	"mysql":       StartTLSMySQL,
+	"pop3":        StartTLSPOP3,
+	"postgres":    StartTLSPostgres,
+	"postgresql":  StartTLSPostgres,
+	"smtp":        StartTLSSMTP,
+	"submission":  StartTLSSMTP,
+	"xmpp":        StartTLSXMPP,
+	"xmpp-client": StartTLSXMPP,
+	"xmpp-server": StartTLSXMPPServer,
+}
+
+// StartTLSFromScheme returns the StartTLS protocol needed to retrieve certificates
+// from a location with the given URL scheme (e.g. "smtp" or "submission" return
+// StartTLSSMTP) or an empty string if the connection starts with TLS.
+func StartTLSFromScheme(scheme string) string {
+	return startTLSSchemes[strings.ToLower(scheme)]
+}
+
+// StartTLSProtocols returns the supported StartTLS protocols.
+func StartTLSProtocols() []string {
+	return []string{
+		StartTLSFTP, StartTLSIMAP, StartTLSLDAP, StartTLSMySQL, StartTLSPOP3,
+		StartTLSPostgres, StartTLSSMTP, StartTLSXMPP, StartTLSXMPPServer,
+	}
+}
+
+// startTLS runs the upgrade dialogue of the given protocol on a plain connection.
+// The server name is used by protocols that address a domain (e.g. XMPP).
+func startTLS(conn net.Conn, protocol, serverName string) error {
+	startTLSFunc, ok := startTLSFuncs[protocol]
+	if !ok {
+		return fmt.Errorf("unsupported StartTLS protocol (%s)", protocol)
+	}
+	return startTLSFunc(conn, serverName)
+}
+
+// startTLSFTP sends AUTH TLS (RFC 4217)
+func startTLSFTP(conn net.Conn, _ string) error {
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	if _, _, err := reader.ReadResponse(220); err != nil {
+		return fmt.Errorf("ftp greeting: %s", err)
+	}
+	if _, err := fmt.Fprint(conn, "AUTH TLS\r\n"); err != nil {
+		return err
+	}
+	if _, _, err := reader.ReadResponse(234); err != nil {
+		return fmt.Errorf("ftp AUTH TLS: %s", err)
+	}
+	return nil
+}
+
+// startTLSIMAP sends STARTTLS (RFC 3501)
+func startTLSIMAP(conn net.Conn, _ string) error {
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	line, err := reader.ReadLine()
+	if err != nil {
+		return fmt.Errorf("imap greeting: %s", err)
+	}
+	if !strings.HasPrefix(line, "* OK") {
+		return fmt.Errorf("imap greeting: %s", line)
+	}
+
+	if _, err := fmt.Fprint(conn, "a1 STARTTLS\r\n"); err != nil {
+		return err
+	}
+	for {
+		line, err = reader.ReadLine()
+		if err != nil {
+			return fmt.Errorf("imap STARTTLS: %s", err)
+		}
+		if strings.HasPrefix(line, "* ") { // untagged responses
+			continue
+		}
+		if !strings.HasPrefix(line, "a1 OK") {
+			return fmt.Errorf("imap STARTTLS: %s", line)
+		}
+		return nil
+	}
+}
+
+// startTLSLDAP sends a StartTLS extended request (RFC 4511)
+func startTLSLDAP(conn net.Conn, _ string) error {
+	requestName, err := asn1.Marshal(asn1.RawValue{
+		Class: asn1.ClassContextSpecific, Tag: 0, Bytes: []byte(ldapStartTLSOID)})
+	if err != nil {
+		return err
+	}
+	response, err := ldapRoundTrip(conn, 1, 23, requestName)
+	if err != nil {
+		return fmt.Errorf("ldap StartTLS: %s", err)
+	}
+	if response.ProtocolOp.Tag != 24 {
+		return errors.New("ldap StartTLS: unexpected response")
+	}
+	if err := ldapResultError(response.ProtocolOp.Bytes); err != nil {
+		return fmt.Errorf("ldap StartTLS: %s", err)
+	}
+	return nil
+}
+
+// startTLSMySQL answers the initial handshake packet with a SSLRequest packet
+func startTLSMySQL(conn net.Conn, _ string) error {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fmt.Errorf("mysql handshake: %s", err)
+	}
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return fmt.Errorf("mysql handshake: %s", err)
+	}
+
+	if len(payload) > 3 && payload[0] == 0xff { // ERR packet
+		return errors.New("mysql: " + string(payload[3:]))
+	}
+	if len(payload) == 0 || payload[0] != 10 {
+		return errors.New("mysql: unsupported protocol version")
+	}
+
+	// protocol version, server version, connection id, auth-plugin-data-part-1, filler
+	pos := bytes.IndexByte(payload[1:], 0)
+	if pos < 0 || len(payload) < 1+pos+1+4+8+1+2 {
+		return errors.New("mysql: invalid handshake packet")
+	}
+	pos += 1 + 1 + 4 + 8 + 1
+	capabilities := uint32(binary.LittleEndian.Uint16(payload[pos : pos+2]))
+	if capabilities&mysqlClientSSL == 0 {
+		return errors.New("mysql: server does not support SSL")
+	}
+
+	request := make([]byte, 4+32)
+	request[0] = 32 // payload length
+	request[3] = 1  // sequence id
+	binary.LittleEndian.PutUint32(request[4:8],
+		mysqlClientProtocol41|mysqlClientSSL|mysqlClientSecureConnection)
+	binary.LittleEndian.PutUint32(request[8:12], 1<<24) // max packet size
+	request[12] = 33                                    // utf8_general_ci
+	_, err := conn.Write(request)
+	return err
+}
+
+// startTLSPOP3 sends STLS (RFC 2595)
+func startTLSPOP3(conn net.Conn, _ string) error {
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	line, err := reader.ReadLine()
+	if err != nil {
+		return fmt.Errorf("pop3 greeting: %s", err)
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return errors.New("pop3 greeting: " + line)
+	}
+
+	if _, err := fmt.Fprint(conn, "STLS\r\n"); err != nil {
+		return err
+	}
+	line, err = reader.ReadLine()
+	if err != nil {
+		return fmt.Errorf("pop3 STLS: %s", err)
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return errors.New("pop3 STLS: " + line)
+	}
+	return nil
+}
+
+// startTLSPostgres sends a SSLRequest message
+func startTLSPostgres(conn net.Conn, _ string) error {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], 80877103) // SSLRequest code
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return fmt.Errorf("postgres SSLRequest: %s", err)
+	}
+	if answer[0] != 'S' {
+		return errors.New("postgres: server does not support SSL")
+	}
+	return nil
+}
+
+// startTLSSMTP sends EHLO and STARTTLS (RFC 3207)
+func startTLSSMTP(conn net.Conn, _ string) error {
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	if _, _, err := reader.ReadResponse(220); err != nil {
+		return fmt.Errorf("smtp greeting: %s", err)
+	}
+	if _, err := fmt.Fprint(conn, "EHLO certmin\r\n"); err != nil {
+		return err
+	}
+	_, msg, err := reader.ReadResponse(250)
+	if err != nil {
+		return fmt.Errorf("smtp EHLO: %s", err)
+	}
+	if !strings.Contains(strings.ToUpper(msg), "STARTTLS") {
+		return errors.New("smtp: server does not offer STARTTLS")
+	}
+	if _, err := fmt.Fprint(conn, "STARTTLS\r\n"); err != nil {
+		return err
+	}
+	if _, _, err := reader.ReadResponse(220); err != nil {
+		return fmt.Errorf("smtp STARTTLS: %s", err)
+	}
+	return nil
+}
+
+// startTLSXMPP negotiates STARTTLS on a XMPP stream (RFC 6120)
+func startTLSXMPP(conn net.Conn, serverName, namespace string) error {
+	var to bytes.Buffer
+	if err := xml.EscapeText(&to, []byte(serverName)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream to='%s' version='1.0' "+
+		"xmlns='%s' xmlns:stream='%s'>", to.String(), namespace, xmppNSStream)
+	if err != nil {
+		return err
+	}
+
+	decoder := xml.NewDecoder(conn)
+	element, err := nextXMLElement(decoder)
+	if err != nil || element.Name.Space != xmppNSStream || element.Name.Local != "stream" {
+		return errors.New("xmpp: invalid stream header")
+	}
+	element, err = nextXMLElement(decoder)
+	if err != nil || element.Name.Space != xmppNSStream || element.Name.Local != "features" {
+		return errors.New("xmpp: no stream features received")
+	}
+	var features struct {
+		StartTLS *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	}
+	if err := decoder.DecodeElement(&features, element); err != nil {
+		return fmt.Errorf("xmpp: %s", err)
+	}
+	if features.StartTLS == nil {
+		return errors.New("xmpp: server does not offer STARTTLS")
+	}
+
+	if _, err := fmt.Fprintf(conn, "<starttls xmlns='%s'/>", xmppNSTLS); err != nil {
+		return err
+	}
+	element, err = nextXMLElement(decoder)
+	if err != nil {
+		return fmt.Errorf("xmpp STARTTLS: %s", err)
+	}
+	if element.Name.Space != xmppNSTLS || element.Name.Local != "proceed" {
+		return fmt.Errorf("xmpp STARTTLS: %s", element.Name.Local)
+	}
+	return nil
+}
+
+// startTLSXMPPClient negotiates STARTTLS on a XMPP client-to-server stream
+func startTLSXMPPClient(conn net.Conn, serverName string) error {
+	return startTLSXMPP(conn, serverName, xmppNSClient)
+}
+
+// startTLSXMPPServer negotiates STARTTLS on a XMPP server-to-server stream
+func startTLSXMPPServer(conn net.Conn, serverName string) error {
+	return startTLSXMPP(conn, serverName, xmppNSServer)
+}
+
+// nextXMLElement returns the next start element of a XML stream
+func nextXMLElement(decoder *xml.Decoder) (*xml.StartElement, error) {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if element, ok := token.(xml.StartElement); ok {
+			return &element, nil
+		}
+	}
+}
+
+// readBERElement reads a single BER encoded element with a definite length of at
+// most maxResponseSize bytes
+func readBERElement(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		lengthBytes := make([]byte, length&0x7f)
+		if len(lengthBytes) == 0 || len(lengthBytes) > 3 {
+			return nil, errors.New("unsupported BER length")
+		}
+		if _, err := io.ReadFull(reader, lengthBytes); err != nil {
+			return nil, err
+		}
+		header = append(header, lengthBytes...)
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxResponseSize {
+		return nil, fmt.Errorf("BER element larger than %d bytes", maxResponseSize)
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return nil, err
+	}
+	return append(header, content...), nil
+}
@@ -0,0 +1,272 @@
+package certmin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testDialogue runs a fake server dialogue on one side of a pipe
+// and returns the client side.
+func testDialogue(serverLines func(net.Conn, *bufio.Reader)) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		serverLines(server, bufio.NewReader(server))
+	}()
+	return client
+}
+
+func testSMTPDialogue(conn net.Conn, r *bufio.Reader) {
+	fmt.Fprint(conn, "220-localhost ESMTP\r\n220 ready\r\n")
+	r.ReadString('\n')
+	fmt.Fprint(conn, "250-localhost\r\n250-PIPELINING\r\n250 STARTTLS\r\n")
+	r.ReadString('\n')
+	fmt.Fprint(conn, "220 go ahead\r\n")
+}
+
+func TestStartTLSFromScheme(t *testing.T) {
+	assert.Equal(t, StartTLSSMTP, StartTLSFromScheme("smtp"))
+	assert.Equal(t, StartTLSSMTP, StartTLSFromScheme("Submission"))
+	assert.Equal(t, StartTLSIMAP, StartTLSFromScheme("imap"))
+	assert.Equal(t, StartTLSPostgres, StartTLSFromScheme("postgresql"))
+	assert.Equal(t, StartTLSMySQL, StartTLSFromScheme("mysql"))
+	assert.Equal(t, StartTLSLDAP, StartTLSFromScheme("ldap"))
+	assert.Equal(t, StartTLSXMPPServer, StartTLSFromScheme("xmpp-server"))
+	assert.Equal(t, "", StartTLSFromScheme("smtps"))
+	assert.Equal(t, "", StartTLSFromScheme("https"))
+}
+
+func TestStartTLSProtocols(t *testing.T) {
+	for _, protocol := range StartTLSProtocols() {
+		assert.Contains(t, startTLSFuncs, protocol)
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	conn := testDialogue(testSMTPDialogue)
+	assert.NoError(t, startTLS(conn, StartTLSSMTP, ""))
+
+	conn = testDialogue(testSMTPDialogue)
+	assert.Error(t, startTLS(conn, "foo", ""))
+}
+
+func TestStartTLSFTP(t *testing.T) {
+	conn := testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprint(conn, "220-Welcome\r\n220 FTP ready\r\n")
+		r.ReadString('\n')
+		fmt.Fprint(conn, "234 AUTH TLS successful\r\n")
+	})
+	assert.NoError(t, startTLSFTP(conn, ""))
+
+	conn = testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprint(conn, "220 FTP ready\r\n")
+		r.ReadString('\n')
+		fmt.Fprint(conn, "504 not supported\r\n")
+	})
+	assert.Error(t, startTLSFTP(conn, ""))
+}
+
+func TestStartTLSIMAP(t *testing.T) {
+	conn := testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprint(conn, "* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n")
+		r.ReadString('\n')
+		fmt.Fprint(conn, "* CAPABILITY IMAP4rev1\r\na1 OK Begin TLS negotiation now\r\n")
+	})
+	assert.NoError(t, startTLSIMAP(conn, ""))
+
+	conn = testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprint(conn, "* OK ready\r\n")
+		r.ReadString('\n')
+		fmt.Fprint(conn, "a1 BAD unknown command\r\n")
+	})
+	assert.Error(t, startTLSIMAP(conn, ""))
+
+	conn = testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprint(conn, "* BYE\r\n")
+	})
+	assert.Error(t, startTLSIMAP(conn, ""))
+}
+
+// testLDAPResponse returns an ExtendedResponse with the given result code
+func testLDAPResponse(resultCode int) []byte {
+	code, _ := asn1.Marshal(asn1.Enumerated(resultCode))
+	empty, _ := asn1.Marshal([]byte{})
+	diagnostic, _ := asn1.Marshal([]byte("unavailable"))
+	response, _ := asn1.Marshal(struct {
+		MessageID  int
+		ProtocolOp asn1.RawValue
+	}{1, asn1.RawValue{Class: asn1.ClassApplication, Tag: 24, IsCompound: true,
+		Bytes: append(append(code, empty...), diagnostic...)}})
+	return response
+}
+
+// testXMPPDialogue runs the server side of a XMPP STARTTLS negotiation
+func testXMPPDialogue(features string, received chan string) func(net.Conn, *bufio.Reader) {
+	return func(conn net.Conn, r *bufio.Reader) {
+		decoder := xml.NewDecoder(r)
+		element, _ := nextXMLElement(decoder)
+		for _, attr := range element.Attr {
+			if attr.Name.Local == "to" {
+				received <- attr.Value
+			}
+		}
+		fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream from='example.com' id='1' version='1.0' "+
+			"xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>"+
+			"<stream:features>%s</stream:features>", features)
+		element, _ = nextXMLElement(decoder)
+		if element != nil && element.Name.Local == "starttls" {
+			fmt.Fprint(conn, "<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+		}
+	}
+}
+
+func TestStartTLSLDAP(t *testing.T) {
+	received := make(chan []byte, 1)
+	conn := testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		request, _ := readBERElement(r)
+		received <- request
+		conn.Write(testLDAPResponse(0))
+	})
+	assert.NoError(t, startTLSLDAP(conn, ""))
+	assert.Contains(t, string(<-received), ldapStartTLSOID)
+
+	conn = testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		readBERElement(r)
+		conn.Write(testLDAPResponse(52))
+	})
+	err := startTLSLDAP(conn, "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unavailable")
+	}
+}
+
+// testMySQLHandshake returns a MySQL initial handshake packet
+func testMySQLHandshake(capabilities uint16) []byte {
+	payload := []byte{10}
+	payload = append(payload, []byte("8.0.22\x00")...)
+	payload = append(payload, 1, 0, 0, 0)            // connection id
+	payload = append(payload, []byte("abcdefgh")...) // auth-plugin-data-part-1
+	payload = append(payload, 0)                     // filler
+	payload = append(payload, byte(capabilities), byte(capabilities>>8))
+	payload = append(payload, 33, 2, 0, 0, 0) // charset, status, upper capabilities
+	return append([]byte{byte(len(payload)), 0, 0, 0}, payload...)
+}
+
+func TestStartTLSMySQL(t *testing.T) {
+	received := make(chan []byte, 1)
+	conn := testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		conn.Write(testMySQLHandshake(0xffff))
+		request := make([]byte, 36)
+		io.ReadFull(r, request)
+		received <- request
+	})
+	assert.NoError(t, startTLSMySQL(conn, ""))
+	request := <-received
+	assert.Equal(t, byte(32), request[0])
+	assert.Equal(t, byte(1), request[3])
+	assert.NotZero(t, binary.LittleEndian.Uint32(request[4:8])&mysqlClientSSL)
+
+	conn = testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		conn.Write(testMySQLHandshake(0xffff &^ mysqlClientSSL))
+	})
+	assert.Error(t, startTLSMySQL(conn, ""))
+
+	conn = testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		conn.Write([]byte{9, 0, 0, 0, 0xff, 0x6a, 0x04, 'b', 'l', 'o', 'c', 'k', 'd'})
+	})
+	assert.Error(t, startTLSMySQL(conn, ""))
+}
+
+func TestStartTLSPOP3(t *testing.T) {
+	conn := testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprint(conn, "+OK POP3 ready\r\n")
+		r.ReadString('\n')
+		fmt.Fprint(conn, "+OK Begin TLS negotiation\r\n")
+	})
+	assert.NoError(t, startTLSPOP3(conn, ""))
+
+	conn = testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprint(conn, "+OK POP3 ready\r\n")
+		r.ReadString('\n')
+		fmt.Fprint(conn, "-ERR command not supported\r\n")
+	})
+	assert.Error(t, startTLSPOP3(conn, ""))
+}
+
+func TestStartTLSPostgres(t *testing.T) {
+	received := make(chan []byte, 1)
+	conn := testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		request := make([]byte, 8)
+		io.ReadFull(r, request)
+		received <- request
+		conn.Write([]byte("S"))
+	})
+	assert.NoError(t, startTLSPostgres(conn, ""))
+	request := <-received
+	assert.Equal(t, []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}, request)
+
+	conn = testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		io.ReadFull(r, make([]byte, 8))
+		conn.Write([]byte("N"))
+	})
+	assert.Error(t, startTLSPostgres(conn, ""))
+}
+
+func TestStartTLSXMPP(t *testing.T) {
+	received := make(chan string, 1)
+	starttls := "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls>"
+	conn := testDialogue(testXMPPDialogue(starttls, received))
+	assert.NoError(t, startTLSXMPPClient(conn, "example.com"))
+	assert.Equal(t, "example.com", <-received)
+
+	conn = testDialogue(testXMPPDialogue("<mechanisms/>", received))
+	assert.Error(t, startTLSXMPPServer(conn, "example.com"))
+	assert.Equal(t, "example.com", <-received)
+	conn.Close()
+
+	conn = testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		r.ReadString('>')
+		fmt.Fprint(conn, "HTTP/1.1 400 Bad Request\r\n")
+	})
+	assert.Error(t, startTLSXMPPClient(conn, "example.com"))
+}
+
+func TestReadBERElement(t *testing.T) {
+	long, _ := asn1.Marshal(make([]byte, 300))
+	element, err := readBERElement(bytes.NewReader(append(long, 1, 2, 3)))
+	assert.NoError(t, err)
+	assert.Equal(t, long, element)
+
+	_, err = readBERElement(bytes.NewReader(long[:100]))
+	assert.Error(t, err)
+
+	// Rejected before reading the content
+	_, err = readBERElement(bytes.NewReader([]byte{0x30, 0x83, 0x20, 0, 0}))
+	assert.EqualError(t, err, fmt.Sprintf("BER element larger than %d bytes", maxResponseSize))
+}
+
+func TestStartTLSSMTP(t *testing.T) {
+	conn := testDialogue(testSMTPDialogue)
+	assert.NoError(t, startTLSSMTP(conn, ""))
+
+	conn = testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+		r.ReadString('\n')
+		fmt.Fprint(conn, "250-localhost\r\n250 PIPELINING\r\n")
+	})
+	assert.Error(t, startTLSSMTP(conn, ""))
+
+	conn = testDialogue(func(conn net.Conn, r *bufio.Reader) {
+		fmt.Fprint(conn, "554 no service\r\n")
+	})
+	assert.Error(t, startTLSSMTP(conn, ""))
+}
@@ -0,0 +1,137 @@
+package certmin
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+)
+
+// CertVariant represents a distinct certificate chain offered by a remote host.
+// Handshakes lists the descriptions of the handshakes (e.g. "TLS 1.2, RSA") that
+// returned the chain.
+type CertVariant struct {
+	Chain      []*x509.Certificate
+	Handshakes []string
+}
+
+// variantProbe is a handshake with specific client preferences
+type variantProbe struct {
+	description string
+	configure   func(*tls.Config)
+}
+
+// RetrieveCertVariants retrieves all the distinct certificate chains offered by the
+// remote host, e.g. an ECDSA certificate for modern clients and a RSA certificate
+// for others. Handshakes are made with the default settings, ECDSA and RSA cipher
+// suites, each supported curve, the h2 and http/1.1 ALPN protocols and without
+// SNI. As parameters it takes an address string like RetrieveCertsFromAddr and a
+// *RetrieveOptions (nil for the defaults). The return values are a []CertVariant
+// in the order in which the chains were found and an error if no handshake
+// succeeded.
+func RetrieveCertVariants(addr string, options *RetrieveOptions) ([]CertVariant, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+	return clientForOptions(options).RetrieveCertVariants(context.Background(), addr, options)
+}
+
+// RetrieveCertVariants retrieves all the distinct certificate chains offered by
+// the remote host like the RetrieveCertVariants function, with a context.Context
+// to cancel the retrieval.
+func (client *Client) RetrieveCertVariants(
+	ctx context.Context, addr string, options *RetrieveOptions) ([]CertVariant, error) {
+	if options == nil {
+		options = &RetrieveOptions{}
+	}
+
+	var variants []CertVariant
+	var lastErr error
+	found := make(map[string]int)
+	for _, probe := range variantProbes(options) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		result, err := client.handshake(ctx, addr, options, probe.configure)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		key := chainKey(result.PeerCertificates)
+		if idx, ok := found[key]; ok {
+			variants[idx].Handshakes = append(variants[idx].Handshakes, probe.description)
+			continue
+		}
+		found[key] = len(variants)
+		variants = append(variants,
+			CertVariant{Chain: result.PeerCertificates, Handshakes: []string{probe.description}})
+	}
+
+	if len(variants) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no certificates found")
+		}
+		return nil, lastErr
+	}
+	return variants, nil
+}
+
+// chainKey returns a key identifying a certificate chain
+func chainKey(chain []*x509.Certificate) string {
+	var key []byte
+	for _, cert := range chain {
+		digest := sha256.Sum256(cert.Raw)
+		key = append(key, digest[:]...)
+	}
+	return string(key)
+}
+
+// variantProbes returns the handshakes used to find certificate variants
+func variantProbes(options *RetrieveOptions) []variantProbe {
+	var ecdsaSuites, rsaSuites []uint16
+	for _, suite := range tls.CipherSuites() {
+		for _, version := range suite.SupportedVersions {
+			if version != tls.VersionTLS12 {
+				continue
+			}
+			if strings.Contains(suite.Name, "_ECDSA_") {
+				ecdsaSuites = append(ecdsaSuites, suite.ID)
+			} else {
+				rsaSuites = append(rsaSuites, suite.ID)
+			}
+		}
+	}
+	tls12 := func(suites []uint16, curves []tls.CurveID) func(*tls.Config) {
+		return func(config *tls.Config) {
+			config.MaxVersion = tls.VersionTLS12
+			config.CipherSuites = suites
+			config.CurvePreferences = curves
+		}
+	}
+
+	probes := []variantProbe{
+		{"default", nil},
+		{"TLS 1.2, ECDSA", tls12(ecdsaSuites, nil)},
+		{"TLS 1.2, RSA", tls12(rsaSuites, nil)},
+	}
+	for _, curve := range []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521, tls.X25519} {
+		probes = append(probes,
+			variantProbe{"TLS 1.2, ECDSA, " + curveNames[curve], tls12(ecdsaSuites, []tls.CurveID{curve})})
+	}
+	if options.StartTLS == "" {
+		for _, protocol := range []string{"h2", "http/1.1"} {
+			protocols := []string{protocol}
+			probes = append(probes, variantProbe{"ALPN " + protocol,
+				func(config *tls.Config) { config.NextProtos = protocols }})
+		}
+	}
+	if !options.NoSNI {
+		probes = append(probes, variantProbe{"no SNI",
+			func(config *tls.Config) { config.ServerName = "" }})
+	}
+
+	return probes
+}
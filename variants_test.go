@@ -0,0 +1,70 @@
+package certmin
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_RetrieveCertVariants(t *testing.T) {
+	addr := startTestServer(t, nil)
+	var dialed []string
+	dial := func(ctx context.Context, network, dialAddr string) (net.Conn, error) {
+		dialed = append(dialed, dialAddr)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	client := NewClient(WithDialContext(dial), WithTimeout(5*time.Second))
+	variants, err := client.RetrieveCertVariants(
+		context.Background(), "myserver:443", &RetrieveOptions{Proxy: ProxyDirect})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(variants)) {
+		assert.Equal(t, "myserver", variants[0].Chain[0].Subject.CommonName)
+	}
+	assert.Equal(t, "myserver:443", dialed[0])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.RetrieveCertVariants(ctx, "myserver:443", &RetrieveOptions{Proxy: ProxyDirect})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestRetrieveCertVariants(t *testing.T) {
+	rsaCert, err := tls.LoadX509KeyPair("t/myserver.crt", "t/myserver.key")
+	assert.NoError(t, err)
+	ecdsaCert, err := tls.LoadX509KeyPair("t/ecdsa_prime256v1.crt", "t/ecdsa_prime256v1.key")
+	assert.NoError(t, err)
+
+	addr := startTestServerWithConfig(t, nil, &tls.Config{Certificates: []tls.Certificate{rsaCert, ecdsaCert}})
+	variants, err := RetrieveCertVariants(addr, &RetrieveOptions{Timeout: 5 * time.Second})
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(variants)) {
+		assert.Equal(t, "myserver", variants[0].Chain[0].Subject.CommonName)
+		assert.Contains(t, variants[0].Handshakes, "default")
+		assert.Contains(t, variants[0].Handshakes, "TLS 1.2, RSA")
+		assert.Equal(t, "certmin", variants[1].Chain[0].Subject.CommonName)
+		assert.Contains(t, variants[1].Handshakes, "TLS 1.2, ECDSA, P-256")
+	}
+
+	addr = startTestServer(t, nil)
+	variants, err = RetrieveCertVariants(addr, nil)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(variants)) {
+		assert.Contains(t, variants[0].Handshakes, "ALPN h2")
+		assert.NotContains(t, variants[0].Handshakes, "TLS 1.2, ECDSA")
+	}
+
+	_, err = RetrieveCertVariants("127.0.0.1:1", nil)
+	assert.Error(t, err)
+}
+
+func TestChainKey(t *testing.T) {
+	certs, err := DecodeCertFile("t/chain.crt", "")
+	assert.NoError(t, err)
+	assert.Equal(t, chainKey(certs), chainKey(certs))
+	assert.NotEqual(t, chainKey(certs), chainKey(certs[:1]))
+	assert.Equal(t, "", chainKey(nil))
+}